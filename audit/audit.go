@@ -0,0 +1,129 @@
+// Package audit keeps an append-only history of changes to users,
+// categories and transactions: who changed which fields, and from what to
+// what.
+package audit
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Resources
+const (
+	User        = "user"
+	Category    = "category"
+	Transaction = "transaction"
+)
+
+// Actions
+const (
+	Create  = "create"
+	Update  = "update"
+	Delete  = "delete"
+	Restore = "restore"
+	// Purge is the permanent removal of a deleted resource once the trash
+	// retention has passed. It has no actor.
+	Purge = "purge"
+)
+
+// Change is one field, as a dotted path into the document, with its value
+// before and after. A missing side means the field did not exist.
+type Change struct {
+	Field  string      `json:"field" bson:"field"`
+	Before interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+type Entry struct {
+	ID         primitive.ObjectID  `json:"id" bson:"_id"`
+	Resource   string              `json:"resource" bson:"resource"`
+	ResourceID primitive.ObjectID  `json:"resourceId" bson:"resourceId"`
+	Ledger     *primitive.ObjectID `json:"ledger,omitempty" bson:"ledger,omitempty"`
+	Action     string              `json:"action" bson:"action"`
+	Actor      *primitive.ObjectID `json:"actor,omitempty" bson:"actor,omitempty"`
+	RequestID  string              `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	At         time.Time           `json:"at" bson:"at"`
+	Changes    []Change            `json:"changes" bson:"changes"`
+}
+
+// Query selects entries, newest first. Zero fields do not filter.
+type Query struct {
+	Resource   string
+	ResourceID *primitive.ObjectID
+	Ledger     *primitive.ObjectID
+	Actor      *primitive.ObjectID
+	// Before pages through older entries: it is the ID of the last entry
+	// of the previous page.
+	Before *primitive.ObjectID
+	Limit  int
+}
+
+// Log appends entries and reads them back. It never updates or deletes
+// one.
+type Log struct {
+	collection *mongo.Collection
+}
+
+// NewLog keeps entries in the named collection. Nested values decode as
+// plain documents so they render as JSON objects.
+func NewLog(db *mongo.Database, name string) *Log {
+	registry := bson.NewRegistryBuilder().
+		RegisterTypeMapEntry(bsontype.EmbeddedDocument, reflect.TypeOf(bson.M{})).
+		Build()
+	return &Log{collection: db.Collection(name, options.Collection().SetRegistry(registry))}
+}
+
+func (log *Log) Record(ctx context.Context, entry Entry) error {
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	if entry.At.IsZero() {
+		entry.At = time.Now()
+	}
+	if entry.Changes == nil {
+		entry.Changes = []Change{}
+	}
+
+	_, err := log.collection.InsertOne(ctx, entry)
+	return err
+}
+
+func (log *Log) Find(ctx context.Context, query Query) ([]Entry, error) {
+	filter := bson.M{}
+	if query.Resource != "" {
+		filter["resource"] = query.Resource
+	}
+	if query.ResourceID != nil {
+		filter["resourceId"] = *query.ResourceID
+	}
+	if query.Ledger != nil {
+		filter["ledger"] = *query.Ledger
+	}
+	if query.Actor != nil {
+		filter["actor"] = *query.Actor
+	}
+	if query.Before != nil {
+		filter["_id"] = bson.M{"$lt": *query.Before}
+	}
+
+	// ObjectIDs grow with time, so _id orders entries as they were written.
+	cur, err := log.collection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{"_id", -1}}).
+		SetLimit(int64(query.Limit)))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0)
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,118 @@
+package audit
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Redacted stands in for the value of a secret field, so the log shows
+// that it changed without keeping it.
+const Redacted = "[redacted]"
+
+type policy struct {
+	// ignore lists fields that change as bookkeeping rather than as an
+	// edit, redact those whose values must not be kept.
+	ignore []string
+	redact []string
+}
+
+var policies = map[string]policy{
+	User: {
+		ignore: []string{"categories", "transactions", "mfa.lastStep"},
+		redact: []string{"password", "mfa.secret", "mfa.pendingSecret", "mfa.recoveryCodes"},
+	},
+}
+
+// always ignored: the ID is on the entry and the version bumps with every
+// update.
+var ignored = []string{"_id", "version"}
+
+// Document converts a model to the form it is stored in, for diffing
+// against documents read from the database.
+func Document(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.M
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// Diff lists the fields of a resource that differ between before and
+// after. A nil before is a creation, a nil after a removal.
+func Diff(resource string, before, after bson.M) []Change {
+	policy := policies[resource]
+	previous, current := map[string]interface{}{}, map[string]interface{}{}
+	flatten("", before, previous)
+	flatten("", after, current)
+
+	fields := []string{}
+	for field := range previous {
+		fields = append(fields, field)
+	}
+	for field := range current {
+		if _, ok := previous[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []Change{}
+	for _, field := range fields {
+		if matches(field, ignored) || matches(field, policy.ignore) {
+			continue
+		}
+
+		was, is := previous[field], current[field]
+		if reflect.DeepEqual(was, is) {
+			continue
+		}
+
+		if matches(field, policy.redact) {
+			if was != nil {
+				was = Redacted
+			}
+			if is != nil {
+				is = Redacted
+			}
+		}
+		changes = append(changes, Change{Field: field, Before: was, After: is})
+	}
+
+	return changes
+}
+
+// flatten writes the leaves of doc to out under dotted paths. Arrays are
+// leaves: an edit to one element shows the whole array.
+func flatten(prefix string, doc interface{}, out map[string]interface{}) {
+	switch doc := doc.(type) {
+	case bson.M:
+		for key, value := range doc {
+			flatten(prefix+key+".", value, out)
+		}
+	case primitive.D:
+		for _, e := range doc {
+			flatten(prefix+e.Key+".", e.Value, out)
+		}
+	default:
+		if prefix != "" {
+			out[strings.TrimSuffix(prefix, ".")] = doc
+		}
+	}
+}
+
+// matches reports whether field is one of paths or nested under one.
+func matches(field string, paths []string) bool {
+	for _, path := range paths {
+		if field == path || strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
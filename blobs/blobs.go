@@ -0,0 +1,134 @@
+// Package blobs stores uploaded files behind a small interface so the
+// backing storage can be chosen by configuration.
+package blobs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the blob's content; the caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds when the blob does not exist.
+	Delete(ctx context.Context, key string) error
+}
+
+// FileStore keeps blobs as files in a directory on the local filesystem.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path keeps keys inside the store's directory.
+func (store *FileStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", errors.New("invalid blob key")
+	}
+	return filepath.Join(store.dir, key), nil
+}
+
+// Put writes to a temporary file first so a failed upload never leaves a
+// partial blob behind.
+func (store *FileStore) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(store.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (store *FileStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (store *FileStore) Delete(ctx context.Context, key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// GridFSStore keeps blobs in a Mongo GridFS bucket, using the key as the
+// file id. The driver's uploads and downloads do not take a context, so
+// only deletes honour ctx.
+type GridFSStore struct {
+	bucket *gridfs.Bucket
+}
+
+func NewGridFSStore(db *mongo.Database, bucket string) (*GridFSStore, error) {
+	b, err := gridfs.NewBucket(db, &options.BucketOptions{Name: &bucket})
+	if err != nil {
+		return nil, err
+	}
+	return &GridFSStore{bucket: b}, nil
+}
+
+func (store *GridFSStore) Put(ctx context.Context, key string, r io.Reader) error {
+	return store.bucket.UploadFromStreamWithID(key, key, r)
+}
+
+func (store *GridFSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	stream, err := store.bucket.OpenDownloadStream(key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (store *GridFSStore) Delete(ctx context.Context, key string) error {
+	err := store.bucket.DeleteContext(ctx, key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil
+	}
+	return err
+}
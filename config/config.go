@@ -0,0 +1,238 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+type Config struct {
+	Addr            string
+	LogLevel        string
+	MongoURI        string
+	Database        string
+	ShutdownTimeout time.Duration
+
+	// TrustedProxies are the addresses or CIDR ranges allowed to report
+	// the client address in X-Forwarded-For. None are trusted by default.
+	TrustedProxies []string
+
+	// Upper bounds for a single request's database work.
+	DBReadTimeout  time.Duration
+	DBWriteTimeout time.Duration
+
+	// Startup retries connecting to Mongo with exponential backoff,
+	// starting at ConnectBackoff and capped at ConnectMaxBackoff.
+	ConnectAttempts   int
+	ConnectBackoff    time.Duration
+	ConnectMaxBackoff time.Duration
+
+	// Requests per minute allowed on the auth endpoints, and the sign-in
+	// lockout that starts after LockoutThreshold consecutive failures.
+	AuthRatePerIP      int
+	SignInRatePerEmail int
+	LockoutThreshold   int
+	LockoutBase        time.Duration
+	LockoutMax         time.Duration
+
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSExposedHeaders   []string
+	CORSAllowCredentials bool
+	CORSMaxAge           time.Duration
+
+	// Session JWTs are signed with JWTAlgorithm ("RS256" or "EdDSA") by a
+	// key that is replaced every JWTRotateEvery.
+	JWTAlgorithm   string
+	JWTIssuer      string
+	JWTAudience    string
+	JWTTTL         time.Duration
+	JWTRotateEvery time.Duration
+	// JWTKeyEncryptionKey is a base64 encoded 32 byte key that encrypts the
+	// signing keys stored in Mongo. When empty they are stored unencrypted.
+	JWTKeyEncryptionKey string
+
+	// TokenSecret signs email verification and password reset links. When
+	// empty a random secret is used and links die with the process.
+	TokenSecret              string
+	AppBaseURL               string
+	RequireEmailVerification bool
+	// MFAIssuer names the account in authenticator apps.
+	MFAIssuer string
+
+	// Mailer is "log", "file" or "smtp".
+	Mailer       string
+	MailFrom     string
+	MailDir      string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+
+	// Attachments are kept in BlobStore, "file" (under BlobDir) or
+	// "gridfs", and limited to AttachmentMaxBytes of AttachmentTypes.
+	BlobStore          string
+	BlobDir            string
+	AttachmentMaxBytes int
+	AttachmentTypes    []string
+
+	// TrashRetention is how long deleted categories and transactions can
+	// be restored before they are purged.
+	TrashRetention time.Duration
+
+	// OIDCProviders come from OIDC_PROVIDERS, a list of names, each with
+	// OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL and
+	// optionally _SCOPES.
+	OIDCProviders []OIDCProvider
+	// OIDCCompleteURL is the frontend page a provider sign-in ends on,
+	// given a code to exchange or an error in its query.
+	OIDCCompleteURL string
+
+	// TracingExporter is "stdout", "otlp" or empty to disable tracing.
+	TracingExporter string
+	OTLPEndpoint    string
+}
+
+func Load() Config {
+	appBaseURL := getEnv("APP_BASE_URL", "http://localhost:3000")
+
+	return Config{
+		Addr:               getEnv("ADDR", ":5050"),
+		TrustedProxies:     getList("TRUSTED_PROXIES", ""),
+		LogLevel:           getEnv("LOG_LEVEL", "info"),
+		MongoURI:           getEnv("MONGO_URI", "mongodb://127.0.0.1:27017"),
+		Database:           getEnv("MONGO_DATABASE", "expense"),
+		ShutdownTimeout:    getDuration("SHUTDOWN_TIMEOUT", 15*time.Second),
+		DBReadTimeout:      getDuration("DB_READ_TIMEOUT", 5*time.Second),
+		DBWriteTimeout:     getDuration("DB_WRITE_TIMEOUT", 10*time.Second),
+		ConnectAttempts:    getInt("MONGO_CONNECT_ATTEMPTS", 10),
+		ConnectBackoff:     getDuration("MONGO_CONNECT_BACKOFF", 500*time.Millisecond),
+		ConnectMaxBackoff:  getDuration("MONGO_CONNECT_MAX_BACKOFF", 30*time.Second),
+		AuthRatePerIP:      getInt("AUTH_RATE_PER_IP", 20),
+		SignInRatePerEmail: getInt("SIGNIN_RATE_PER_EMAIL", 5),
+		LockoutThreshold:   getInt("LOCKOUT_THRESHOLD", 5),
+		LockoutBase:        getDuration("LOCKOUT_BASE", time.Minute),
+		LockoutMax:         getDuration("LOCKOUT_MAX", time.Hour),
+		CORSAllowedOrigins: getList("CORS_ALLOWED_ORIGINS", "*"),
+		CORSAllowedMethods: getList("CORS_ALLOWED_METHODS", "GET, POST, PUT, PATCH, DELETE, OPTIONS"),
+		CORSAllowedHeaders: getList("CORS_ALLOWED_HEADERS",
+			"Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Accept, Origin, Cache-Control, X-Requested-With, If-Match, X-Request-ID, X-Ledger-ID"),
+		CORSExposedHeaders:       getList("CORS_EXPOSED_HEADERS", "ETag, X-Request-ID, Retry-After, Deprecation, Sunset, Link"),
+		CORSAllowCredentials:     getBool("CORS_ALLOW_CREDENTIALS", false),
+		CORSMaxAge:               getDuration("CORS_MAX_AGE", 10*time.Minute),
+		JWTAlgorithm:             getEnv("JWT_ALGORITHM", "RS256"),
+		JWTIssuer:                getEnv("JWT_ISSUER", "expense-tracker-api"),
+		JWTAudience:              getEnv("JWT_AUDIENCE", "expense-tracker"),
+		JWTTTL:                   getDuration("JWT_TTL", 100*time.Minute),
+		JWTRotateEvery:           getDuration("JWT_ROTATE_EVERY", 30*24*time.Hour),
+		JWTKeyEncryptionKey:      getEnv("JWT_KEY_ENCRYPTION_KEY", ""),
+		TokenSecret:              getEnv("TOKEN_SECRET", ""),
+		AppBaseURL:               appBaseURL,
+		RequireEmailVerification: getBool("REQUIRE_EMAIL_VERIFICATION", false),
+		MFAIssuer:                getEnv("MFA_ISSUER", "Expense Tracker"),
+		Mailer:                   getEnv("MAILER", "log"),
+		MailFrom:                 getEnv("MAIL_FROM", "Expense Tracker <no-reply@localhost>"),
+		MailDir:                  getEnv("MAIL_DIR", "mail"),
+		SMTPHost:                 getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:                 getInt("SMTP_PORT", 587),
+		SMTPUsername:             getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:             getEnv("SMTP_PASSWORD", ""),
+		BlobStore:                getEnv("BLOB_STORE", "file"),
+		BlobDir:                  getEnv("BLOB_DIR", "attachments"),
+		AttachmentMaxBytes:       getInt("ATTACHMENT_MAX_BYTES", 10<<20),
+		AttachmentTypes:          getList("ATTACHMENT_TYPES", "image/jpeg, image/png, image/gif, image/webp, application/pdf"),
+		TrashRetention:           getDuration("TRASH_RETENTION", 30*24*time.Hour),
+		OIDCProviders:            getOIDCProviders(),
+		OIDCCompleteURL:          getEnv("OIDC_COMPLETE_URL", appBaseURL+"/oidc/complete"),
+		TracingExporter:          getEnv("TRACING_EXPORTER", ""),
+		OTLPEndpoint:             getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "localhost:4318"),
+	}
+}
+
+func getOIDCProviders() []OIDCProvider {
+	providers := []OIDCProvider{}
+	for _, name := range getList("OIDC_PROVIDERS", "") {
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, OIDCProvider{
+			Name:         strings.ToLower(name),
+			Issuer:       getEnv(prefix+"ISSUER", ""),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  getEnv(prefix+"REDIRECT_URL", ""),
+			Scopes:       getList(prefix+"SCOPES", "email, profile"),
+		})
+	}
+	return providers
+}
+
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// getList reads a comma separated list, "" meaning an empty list.
+func getList(key string, fallback string) []string {
+	list := []string{}
+	for _, item := range strings.Split(getEnv(key, fallback), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("invalid config value, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return b
+}
+
+func getInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("invalid config value, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return i
+}
+
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("invalid config value, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/mailer"
+	"expense-tracker-api/models"
+	"expense-tracker-api/tokens"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+// AccountHandler runs the email verification and password reset flows.
+// Both mail a signed, expiring link whose token is consumed on use.
+type AccountHandler struct {
+	collection *mongo.Collection
+	tokens     *tokens.Store
+	signer     *tokens.Signer
+	mailer     mailer.Mailer
+	baseURL    string
+	// auditLog also records the account changes made by AuthHandler,
+	// ProfileHandler and OIDCHandler.
+	auditLog *audit.Log
+	timeouts Timeouts
+}
+
+func NewAccountHandler(timeouts Timeouts, collection *mongo.Collection, store *tokens.Store, signer *tokens.Signer, mail mailer.Mailer, baseURL string, auditLog *audit.Log) *AccountHandler {
+	return &AccountHandler{
+		collection: collection,
+		tokens:     store,
+		signer:     signer,
+		mailer:     mail,
+		baseURL:    baseURL,
+		auditLog:   auditLog,
+		timeouts:   timeouts,
+	}
+}
+
+func (handler *AccountHandler) link(path string, token string) string {
+	return handler.baseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func (handler *AccountHandler) issue(ctx context.Context, purpose tokens.Purpose, user models.User, ttl time.Duration) (string, error) {
+	token, payload, err := handler.signer.Issue(purpose, user.ID.Hex(), user.Email, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	if err := handler.tokens.Save(ctx, payload); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// sendVerification mails a verification link for the user's current email.
+func (handler *AccountHandler) sendVerification(ctx context.Context, user models.User) error {
+	token, err := handler.issue(ctx, tokens.VerifyEmail, user, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	return handler.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nconfirm your email address by opening the link below within 48 hours:\n\n%s\n",
+			user.Username, handler.link("/verify-email", token)),
+	})
+}
+
+func (handler *AccountHandler) sendPasswordReset(ctx context.Context, user models.User) error {
+	token, err := handler.issue(ctx, tokens.ResetPassword, user, resetPasswordTTL)
+	if err != nil {
+		return err
+	}
+
+	return handler.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nreset your password by opening the link below within one hour:\n\n%s\n\nIf you did not ask for this, ignore this email.\n",
+			user.Username, handler.link("/reset-password", token)),
+	})
+}
+
+// consume validates token for purpose and marks it used. It writes the
+// error response and returns false when the token can not be used.
+func (handler *AccountHandler) consume(ctx context.Context, c *gin.Context, token string, purpose tokens.Purpose) (tokens.Payload, bool) {
+	payload, err := handler.signer.Parse(token, purpose)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return payload, false
+	}
+
+	err = handler.tokens.Consume(ctx, payload)
+	if dbTimeout(c, err) {
+		return payload, false
+	}
+
+	if errors.Is(err, tokens.ErrUsed) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return payload, false
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return payload, false
+	}
+
+	return payload, true
+}
+
+// requestFlow answers 202 whether or not the email belongs to an account,
+// so the endpoints can not be used to discover registered addresses.
+func (handler *AccountHandler) requestFlow(c *gin.Context, send func(ctx context.Context, user models.User) error, skip func(user models.User) bool) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.EmailRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	err := handler.collection.FindOne(ctx, bson.M{"email": request.Email}).Decode(&user)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == nil && !skip(user) {
+		if err := send(ctx, user); err != nil {
+			logging.FromContext(ctx).Error("sending account email failed", "error", err)
+		}
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address belongs to an account, an email is on its way"})
+}
+
+func (handler *AccountHandler) RequestEmailVerification(c *gin.Context) {
+	handler.requestFlow(c, handler.sendVerification, func(user models.User) bool {
+		return user.EmailVerified
+	})
+}
+
+func (handler *AccountHandler) ConfirmEmailVerification(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.TokenRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, ok := handler.consume(ctx, c, request.Token, tokens.VerifyEmail)
+	if !ok {
+		return
+	}
+
+	userID, _ := primitive.ObjectIDFromHex(payload.UserID)
+	// Matching the email too ignores links sent before an email change.
+	err := updateUser(ctx, c, handler.auditLog, handler.collection, bson.M{
+		"_id":   userID,
+		"email": payload.Email,
+	}, bson.M{"$set": bson.M{"emailVerified": true}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The email address has changed since this link was sent"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address verified"})
+}
+
+func (handler *AccountHandler) RequestPasswordReset(c *gin.Context) {
+	handler.requestFlow(c, handler.sendPasswordReset, func(user models.User) bool {
+		return false
+	})
+}
+
+func (handler *AccountHandler) ConfirmPasswordReset(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.PasswordReset
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, ok := handler.consume(ctx, c, request.Token, tokens.ResetPassword)
+	if !ok {
+		return
+	}
+
+	password, err := hashPassword(request.Password)
+	if err != nil {
+		hashFailed(c, err)
+		return
+	}
+
+	userID, _ := primitive.ObjectIDFromHex(payload.UserID)
+	// The link went to the address the account had then; one sent to an
+	// address the account has since left must not reset the password.
+	err = updateUser(ctx, c, handler.auditLog, handler.collection, bson.M{
+		"_id":   userID,
+		"email": payload.Email,
+	}, bson.M{"$set": bson.M{"password": password}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The account or its email address has changed since this link was sent"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := handler.tokens.Revoke(ctx, payload.UserID, tokens.ResetPassword); err != nil {
+		logging.FromContext(ctx).Warn("revoking reset tokens failed", "error", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password was successfully changed"})
+}
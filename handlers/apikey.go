@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"expense-tracker-api/logging"
+	"expense-tracker-api/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// apiKeyPrefix marks API keys so AuthMiddleware can tell them from JWTs
+// and secret scanners can find leaked ones.
+const apiKeyPrefix = "etk_"
+
+// lastUsedResolution limits how often using a key writes lastUsedAt.
+const lastUsedResolution = time.Minute
+
+type APIKeyHandler struct {
+	collection *mongo.Collection
+	timeouts   Timeouts
+}
+
+// CreatedAPIKey carries the token, which is shown only once.
+type CreatedAPIKey struct {
+	models.APIKey
+	Token string `json:"token"`
+}
+
+func NewAPIKeyHandler(timeouts Timeouts, collection *mongo.Collection) *APIKeyHandler {
+	return &APIKeyHandler{
+		collection: collection,
+		timeouts:   timeouts,
+	}
+}
+
+func hashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (handler *APIKeyHandler) ListAPIKeys(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	cur, err := handler.collection.Find(ctx, bson.M{"owner": principalOf(c).UserID},
+		options.Find().SetSort(bson.D{{"createdAt", -1}}))
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	defer cur.Close(ctx)
+	keys := make([]models.APIKey, 0)
+
+	for cur.Next(ctx) {
+		var key models.APIKey
+		cur.Decode(&key)
+		keys = append(keys, key)
+	}
+
+	if dbTimeout(c, cur.Err()) {
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func (handler *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.APIKeyRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	token := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	key := models.APIKey{
+		ID:        primitive.NewObjectID(),
+		Owner:     principalOf(c).UserID,
+		Name:      request.Name,
+		Prefix:    token[:len(apiKeyPrefix)+6],
+		Hash:      hashAPIKey(token),
+		Scopes:    request.Scopes,
+		CreatedAt: now,
+	}
+	if request.ExpiresInDays > 0 {
+		expires := now.AddDate(0, 0, request.ExpiresInDays)
+		key.ExpiresAt = &expires
+	}
+
+	_, err := handler.collection.InsertOne(ctx, key)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreatedAPIKey{APIKey: key, Token: token})
+}
+
+// RevokeAPIKey stops a key from working. The record stays so listings
+// show when it was revoked.
+func (handler *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	objectId, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	result, err := handler.collection.UpdateOne(ctx, bson.M{
+		"_id":       objectId,
+		"owner":     principalOf(c).UserID,
+		"revokedAt": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// authenticateAPIKey resolves an API key to its owner with the key's
+// scopes.
+func (sessions *Sessions) authenticateAPIKey(ctx context.Context, token string) (Principal, error) {
+	var key models.APIKey
+	now := time.Now()
+
+	err := sessions.apiKeys.FindOne(ctx, bson.M{
+		"hash":      hashAPIKey(token),
+		"revokedAt": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+			bson.M{"expiresAt": bson.M{"$gt": now}},
+		},
+	}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return Principal{}, errUnknownAPIKey
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+
+	principal, err := sessions.principals.resolve(ctx, key.Owner)
+	if err == mongo.ErrNoDocuments {
+		return Principal{}, errUnknownUser
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > lastUsedResolution {
+		_, err := sessions.apiKeys.UpdateOne(ctx, bson.M{"_id": key.ID}, bson.M{"$set": bson.M{"lastUsedAt": now}})
+		if err != nil {
+			logging.FromContext(ctx).Warn("recording API key use failed", "error", err)
+		}
+	}
+
+	principal.Scopes = key.Scopes
+	principal.APIKeyID = key.ID
+	return principal, nil
+}
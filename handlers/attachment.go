@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"expense-tracker-api/blobs"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/models"
+	"expense-tracker-api/thumbnails"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const thumbnailSize = 256
+
+type AttachmentHandler struct {
+	collection   *mongo.Collection
+	transactions *mongo.Collection
+	store        blobs.Store
+	maxBytes     int64
+	types        map[string]bool
+	timeouts     Timeouts
+}
+
+func NewAttachmentHandler(timeouts Timeouts, collection *mongo.Collection, transactions *mongo.Collection, store blobs.Store, maxBytes int, types []string) *AttachmentHandler {
+	allowed := map[string]bool{}
+	for _, t := range types {
+		allowed[strings.ToLower(t)] = true
+	}
+
+	return &AttachmentHandler{
+		collection:   collection,
+		transactions: transactions,
+		store:        store,
+		maxBytes:     int64(maxBytes),
+		types:        allowed,
+		timeouts:     timeouts,
+	}
+}
+
+func thumbnailKey(id primitive.ObjectID) string {
+	return id.Hex() + "-thumb"
+}
+
+// transactionID checks that the :id transaction is in the selected ledger.
+// When it is not it writes the response and returns false.
+func (handler *AttachmentHandler) transactionID(ctx context.Context, c *gin.Context) (primitive.ObjectID, bool) {
+	id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+
+	err := handler.transactions.FindOne(ctx, bson.M{"_id": id, "ledger": ledgerOf(c).ID, "deletedAt": nil},
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+
+	if dbTimeout(c, err) {
+		return id, false
+	}
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return id, false
+	}
+
+	return id, true
+}
+
+// find loads the :attachmentId attachment of the :id transaction. Like
+// listing, it requires the transaction to be out of the trash.
+func (handler *AttachmentHandler) find(ctx context.Context, c *gin.Context) (models.Attachment, bool) {
+	var attachment models.Attachment
+
+	transactionID, ok := handler.transactionID(ctx, c)
+	if !ok {
+		return attachment, false
+	}
+
+	id, _ := primitive.ObjectIDFromHex(c.Param("attachmentId"))
+
+	err := handler.collection.FindOne(ctx, bson.M{"_id": id, "transaction": transactionID, "ledger": ledgerOf(c).ID}).Decode(&attachment)
+
+	if dbTimeout(c, err) {
+		return attachment, false
+	}
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return attachment, false
+	}
+
+	return attachment, true
+}
+
+// UploadAttachment stores the multipart "file" field. Its type is sniffed
+// from the content rather than trusted from the client, and images also
+// get a thumbnail.
+func (handler *AttachmentHandler) UploadAttachment(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	// Leave room for the multipart framing around the file.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, handler.maxBytes+64<<10)
+
+	transactionID, ok := handler.transactionID(ctx, c)
+	if !ok {
+		return
+	}
+
+	header, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if header.Size > handler.maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !handler.types[contentType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Files of type " + contentType + " are not accepted"})
+		return
+	}
+
+	attachment := models.Attachment{
+		ID:          primitive.NewObjectID(),
+		Transaction: transactionID,
+		Ledger:      ledgerOf(c).ID,
+		Owner:       principalOf(c).UserID,
+		Filename:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now().UTC().Truncate(time.Millisecond),
+	}
+
+	if err := handler.store.Put(ctx, attachment.ID.Hex(), bytes.NewReader(data)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if thumbnails.Supported[contentType] {
+		thumbnail, err := thumbnails.Make(data, thumbnailSize)
+		if err == nil {
+			err = handler.store.Put(ctx, thumbnailKey(attachment.ID), bytes.NewReader(thumbnail))
+		}
+		if err != nil {
+			logging.FromContext(ctx).Warn("thumbnail not created", "attachment", attachment.ID.Hex(), "error", err)
+		}
+		attachment.Thumbnail = err == nil
+	}
+
+	_, err = handler.collection.InsertOne(ctx, attachment)
+
+	if err != nil {
+		handler.removeBlobs(ctx, attachment)
+	}
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+func (handler *AttachmentHandler) ListAttachments(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	transactionID, ok := handler.transactionID(ctx, c)
+	if !ok {
+		return
+	}
+
+	cur, err := handler.collection.Find(ctx, bson.M{"ledger": ledgerOf(c).ID, "transaction": transactionID},
+		options.Find().SetSort(bson.D{{"createdAt", 1}}))
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	defer cur.Close(ctx)
+	attachments := make([]models.Attachment, 0)
+
+	for cur.Next(ctx) {
+		var attachment models.Attachment
+		cur.Decode(&attachment)
+		attachments = append(attachments, attachment)
+	}
+
+	if dbTimeout(c, cur.Err()) {
+		return
+	}
+
+	c.JSON(http.StatusOK, attachments)
+}
+
+func (handler *AttachmentHandler) DownloadAttachment(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	attachment, ok := handler.find(ctx, c)
+	if !ok {
+		return
+	}
+
+	handler.serve(ctx, c, attachment.ID.Hex(), attachment.Size, attachment.ContentType,
+		mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+}
+
+func (handler *AttachmentHandler) DownloadThumbnail(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	attachment, ok := handler.find(ctx, c)
+	if !ok {
+		return
+	}
+
+	if !attachment.Thumbnail {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment has no thumbnail"})
+		return
+	}
+
+	handler.serve(ctx, c, thumbnailKey(attachment.ID), -1, "image/jpeg", "inline")
+}
+
+func (handler *AttachmentHandler) serve(ctx context.Context, c *gin.Context, key string, size int64, contentType string, disposition string) {
+	content, err := handler.store.Get(ctx, key)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == blobs.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment content is missing"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer content.Close()
+
+	c.DataFromReader(http.StatusOK, size, contentType, content, map[string]string{
+		"Content-Disposition":    disposition,
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=86400",
+	})
+}
+
+func (handler *AttachmentHandler) DeleteAttachment(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	attachment, ok := handler.find(ctx, c)
+	if !ok {
+		return
+	}
+
+	_, err := handler.collection.DeleteOne(ctx, bson.M{"_id": attachment.ID})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	handler.removeBlobs(ctx, attachment)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Attachment successfully removed"})
+}
+
+// removeBlobs deletes an attachment's content. Failures only leave an
+// orphaned blob behind, so they are logged rather than reported.
+func (handler *AttachmentHandler) removeBlobs(ctx context.Context, attachment models.Attachment) {
+	keys := []string{attachment.ID.Hex()}
+	if attachment.Thumbnail {
+		keys = append(keys, thumbnailKey(attachment.ID))
+	}
+
+	for _, key := range keys {
+		if err := handler.store.Delete(ctx, key); err != nil {
+			logging.FromContext(ctx).Warn("deleting attachment content failed", "key", key, "error", err)
+		}
+	}
+}
+
+// removeWhere deletes the attachments matching filter along with their
+// content, for when their transaction or ledger goes away.
+func (handler *AttachmentHandler) removeWhere(ctx context.Context, filter bson.M) error {
+	cur, err := handler.collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	var attachments []models.Attachment
+	if err := cur.All(ctx, &attachments); err != nil {
+		return err
+	}
+
+	if _, err := handler.collection.DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		handler.removeBlobs(ctx, attachment)
+	}
+
+	return nil
+}
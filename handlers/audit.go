@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/logging"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 200
+)
+
+// AuditHandler serves the change history that the other handlers record.
+type AuditHandler struct {
+	log      *audit.Log
+	timeouts Timeouts
+}
+
+func NewAuditHandler(timeouts Timeouts, log *audit.Log) *AuditHandler {
+	return &AuditHandler{
+		log:      log,
+		timeouts: timeouts,
+	}
+}
+
+// record appends a change made by the request to the audit log. The change
+// itself is already made, so failing to record it is logged rather than
+// failing the request. Updates that changed nothing are left out.
+func record(ctx context.Context, c *gin.Context, log *audit.Log, resource string, id primitive.ObjectID, action string, changes []audit.Change) {
+	if action == audit.Update && len(changes) == 0 {
+		return
+	}
+
+	entry := audit.Entry{
+		Resource:   resource,
+		ResourceID: id,
+		Action:     action,
+		RequestID:  c.GetString("requestID"),
+		Changes:    changes,
+	}
+
+	// Registration and emailed links have no signed-in caller; the user
+	// they change is the one acting.
+	if value, ok := c.Get(principalKey); ok {
+		actor := value.(Principal).UserID
+		entry.Actor = &actor
+	} else if resource == audit.User {
+		entry.Actor = &id
+	}
+
+	if value, ok := c.Get(ledgerKey); ok && resource != audit.User {
+		ledger := value.(LedgerAccess).ID
+		entry.Ledger = &ledger
+	}
+
+	if err := log.Record(ctx, entry); err != nil {
+		logging.FromContext(ctx).Error("recording audit entry failed", "resource", resource, "id", id.Hex(), "action", action, "error", err)
+	}
+}
+
+// recordCreate records a new resource with every field it was stored with.
+func recordCreate(ctx context.Context, c *gin.Context, log *audit.Log, resource string, id primitive.ObjectID, created interface{}) {
+	doc, err := audit.Document(created)
+	if err != nil {
+		logging.FromContext(ctx).Error("recording audit entry failed", "resource", resource, "id", id.Hex(), "error", err)
+		return
+	}
+
+	record(ctx, c, log, resource, id, audit.Create, audit.Diff(resource, nil, doc))
+}
+
+// updateUser applies update to the user matching filter and records what
+// changed. It returns mongo.ErrNoDocuments when no user matched. Users have
+// no version to pin the read-back to, so a concurrent write to the same
+// user can show up in this entry.
+func updateUser(ctx context.Context, c *gin.Context, log *audit.Log, users *mongo.Collection, filter interface{}, update interface{}) error {
+	var before bson.M
+	err := users.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&before)
+	if err != nil {
+		return err
+	}
+
+	id, _ := before["_id"].(primitive.ObjectID)
+
+	var after bson.M
+	if err := users.FindOne(ctx, bson.M{"_id": id}).Decode(&after); err != nil {
+		logging.FromContext(ctx).Error("reading back audited user failed", "id", id.Hex(), "error", err)
+		return nil
+	}
+
+	record(ctx, c, log, audit.User, id, audit.Update, audit.Diff(audit.User, before, after))
+	return nil
+}
+
+// auditQuery reads the paging parameters shared by the history endpoints.
+func auditQuery(c *gin.Context) (audit.Query, bool) {
+	query := audit.Query{Limit: defaultAuditLimit}
+
+	if limit := c.Query("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit should be between 1 and " + strconv.Itoa(maxAuditLimit)})
+			return query, false
+		}
+		query.Limit = value
+	}
+
+	if before := c.Query("before"); before != "" {
+		id, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before should be the id of an audit entry"})
+			return query, false
+		}
+		query.Before = &id
+	}
+
+	return query, true
+}
+
+func (handler *AuditHandler) find(c *gin.Context, query audit.Query) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	entries, err := handler.log.Find(ctx, query)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// ListAudit lists changes in the selected ledger, newest first, optionally
+// only those of one resource type or made by one user.
+func (handler *AuditHandler) ListAudit(c *gin.Context) {
+	query, ok := auditQuery(c)
+	if !ok {
+		return
+	}
+
+	ledger := ledgerOf(c).ID
+	query.Ledger = &ledger
+
+	switch resource := c.Query("resource"); resource {
+	case "", audit.Category, audit.Transaction:
+		query.Resource = resource
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "resource should be category or transaction"})
+		return
+	}
+
+	if actor := c.Query("actor"); actor != "" {
+		id, err := primitive.ObjectIDFromHex(actor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "actor should be a user id"})
+			return
+		}
+		query.Actor = &id
+	}
+
+	handler.find(c, query)
+}
+
+func (handler *AuditHandler) CategoryHistory(c *gin.Context) {
+	handler.history(c, audit.Category)
+}
+
+func (handler *AuditHandler) TransactionHistory(c *gin.Context) {
+	handler.history(c, audit.Transaction)
+}
+
+// history lists the changes to one resource of the selected ledger,
+// including after it was deleted.
+func (handler *AuditHandler) history(c *gin.Context, resource string) {
+	query, ok := auditQuery(c)
+	if !ok {
+		return
+	}
+
+	id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	ledger := ledgerOf(c).ID
+	query.Resource, query.ResourceID, query.Ledger = resource, &id, &ledger
+
+	handler.find(c, query)
+}
+
+// ProfileHistory lists the changes to the caller's own account.
+func (handler *AuditHandler) ProfileHistory(c *gin.Context) {
+	query, ok := auditQuery(c)
+	if !ok {
+		return
+	}
+
+	id := principalOf(c).UserID
+	query.Resource, query.ResourceID = audit.User, &id
+
+	handler.find(c, query)
+}
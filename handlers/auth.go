@@ -2,25 +2,37 @@ package handlers
 
 import (
 	"context"
-	"crypto/sha256"
 	"errors"
-	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"expense-tracker-api/audit"
+	"expense-tracker-api/ledgers"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/metrics"
+	"expense-tracker-api/migrations"
 	"expense-tracker-api/models"
+	"expense-tracker-api/ratelimit"
 
 	"github.com/go-playground/validator/v10"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type AuthHandler struct {
 	collection *mongo.Collection
-	ctx        context.Context
+	ledgers    *mongo.Collection
+	timeouts   Timeouts
+	lockout    ratelimit.Lockout
+	sessions   *Sessions
+	accounts   *AccountHandler
+	// requireVerified refuses sign-in until the email address is verified.
+	requireVerified bool
 }
 
 type ErrorMsg struct {
@@ -28,9 +40,11 @@ type ErrorMsg struct {
 	Message string `json:"message"`
 }
 
+// Claims identify the user by ObjectID in the subject, which survives an
+// email change. Email is informational only.
 type Claims struct {
 	Email string `json:"email"`
-	jwt.StandardClaims
+	jwt.RegisteredClaims
 }
 
 type JWTOutput struct {
@@ -38,49 +52,40 @@ type JWTOutput struct {
 	Expires time.Time `json:"expires"`
 }
 
-func NewAuthHandler(ctx context.Context, collection *mongo.Collection) *AuthHandler {
+func NewAuthHandler(timeouts Timeouts, collection *mongo.Collection, ledgerCollection *mongo.Collection, lockout ratelimit.Lockout, sessions *Sessions, accounts *AccountHandler, requireVerified bool) *AuthHandler {
 	return &AuthHandler{
-		collection: collection,
-		ctx:        ctx,
+		collection:      collection,
+		ledgers:         ledgerCollection,
+		timeouts:        timeouts,
+		lockout:         lockout,
+		sessions:        sessions,
+		accounts:        accounts,
+		requireVerified: requireVerified,
 	}
 }
 
 func (handler *AuthHandler) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenValue := c.GetHeader("Authorization")
-		claims := &Claims{}
+		ctx, cancel := handler.timeouts.read(c)
+		principal, err := handler.sessions.authenticate(ctx, c.GetHeader("Authorization"))
+		cancel()
 
-		tkn, err := jwt.ParseWithClaims(tokenValue, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte("poler"), nil
-		})
-
-		if claims, ok := tkn.Claims.(*Claims); ok && tkn.Valid {
-			c.Set("email", claims.Email)
+		if dbTimeout(c, err) {
+			return
 		}
 
 		if err != nil {
 			c.AbortWithStatus(http.StatusUnauthorized)
+			return
 		}
 
-		if tkn == nil || !tkn.Valid {
-			c.AbortWithStatus(http.StatusUnauthorized)
-		}
-
-		c.Next()
-	}
-}
+		c.Set(principalKey, principal)
+		metrics.TrackSession(principal.UserID.Hex())
 
-func (handler *AuthHandler) CORSMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
+		// Handler, database and access log records all name the user.
+		requestCtx := c.Request.Context()
+		logger := logging.FromContext(requestCtx).With("user_id", principal.UserID.Hex())
+		c.Request = c.Request.WithContext(logging.WithLogger(requestCtx, logger))
 
 		c.Next()
 	}
@@ -104,56 +109,85 @@ func getErrorMsg(fe validator.FieldError) string {
 }
 
 func (handler *AuthHandler) RegisterUser(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
 	var user models.User
 
 	if err := c.ShouldBindJSON(&user); err != nil {
 		var ve validator.ValidationErrors
 		if errors.As(err, &ve) {
-			fmt.Println(ve)
 			out := make([]ErrorMsg, len(ve))
 			for i, fe := range ve {
 				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
 			}
+			logging.FromContext(ctx).Info("registration rejected", "errors", out)
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+			return
 		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var userFromDB models.User
+	password, err := hashPassword(user.Password)
+	if err != nil {
+		hashFailed(c, err)
+		return
+	}
 
-	userNameErr := handler.collection.FindOne(handler.ctx, bson.M{
-		"username": user.Username,
-	}).Decode(&userFromDB)
+	created := bson.M{
+		"username":      user.Username,
+		"email":         user.Email,
+		"password":      password,
+		"emailVerified": false,
+	}
+	insertResult, err := handler.collection.InsertOne(ctx, created)
 
-	if userNameErr != mongo.ErrNoDocuments && userNameErr == nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"Username": "Username alredy exists"})
+	if dbTimeout(c, err) {
 		return
 	}
 
-	userEmailErr := handler.collection.FindOne(handler.ctx, bson.M{
-		"email": user.Email,
-	}).Decode(&userFromDB)
+	if duplicateKey(err, migrations.UsersUsernameIndex) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"Username": "Username alredy exists"})
+		return
+	}
 
-	if userEmailErr != mongo.ErrNoDocuments && userEmailErr == nil {
+	if duplicateKey(err, migrations.UsersEmailIndex) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"Email": "Email alredy exists"})
 		return
 	}
 
-	h := sha256.New()
-	insertResult, err := handler.collection.InsertOne(handler.ctx, bson.M{
-		"username": user.Username,
-		"email":    user.Email,
-		"password": string(h.Sum([]byte(user.Password))),
-	})
-
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user.ID = insertResult.InsertedID.(primitive.ObjectID)
+	recordCreate(ctx, c, handler.accounts.auditLog, audit.User, user.ID, created)
+	handler.createPersonalLedger(ctx, user.ID)
+
+	if err := handler.accounts.sendVerification(ctx, user); err != nil {
+		logging.FromContext(ctx).Error("sending verification email failed", "error", err)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"user": insertResult.InsertedID})
 }
 
+// createPersonalLedger gives a new user the ledger they start with. Scope
+// creates it later when this fails.
+func (handler *AuthHandler) createPersonalLedger(ctx context.Context, userID primitive.ObjectID) {
+	if _, err := ledgers.EnsurePersonal(ctx, handler.ledgers, userID); err != nil {
+		logging.FromContext(ctx).Error("creating personal ledger failed", "user", userID.Hex(), "error", err)
+	}
+}
+
+// SignInHandler runs under the write timeout: besides reading the account
+// it counts failures, rehashes the password and saves sessions or MFA
+// challenges.
 func (handler *AuthHandler) SignInHandler(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
 	var user models.LogggedInUser
 
 	if err := c.ShouldBindJSON(&user); err != nil {
@@ -161,78 +195,122 @@ func (handler *AuthHandler) SignInHandler(c *gin.Context) {
 		return
 	}
 
-	h := sha256.New()
+	lockoutKey := strings.ToLower(user.Email)
+	if locked, err := handler.lockout.Locked(ctx, lockoutKey); err == nil && locked > 0 {
+		ratelimit.TooManyRequests(c, locked)
+		return
+	}
+
+	var account models.User
+	err := handler.collection.FindOne(ctx, bson.M{"email": user.Email}).Decode(&account)
 
-	cur := handler.collection.FindOne(handler.ctx, bson.M{
-		"email":    user.Email,
-		"password": string(h.Sum([]byte(user.Password))),
-	})
+	if dbTimeout(c, err) {
+		return
+	}
 
-	if cur.Err() != nil {
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	stored := account.Password
+	if err != nil {
+		stored = string(dummyPasswordHash)
+	}
+
+	valid, rehash := checkPassword(stored, user.Password)
+	if err != nil || !valid {
+		metrics.SignInFailures.Inc()
+		if lock, _ := handler.lockout.Fail(ctx, lockoutKey); lock > 0 {
+			logging.FromContext(ctx).Warn("sign-in locked after repeated failures", "locked_for", lock.String())
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
 		return
 	}
 
-	expirationTime := time.Now().Add(100 * time.Minute)
-	claims := &Claims{
-		Email: user.Email,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+	// With 2FA the lockout also counts wrong codes, so only a completed
+	// sign-in may clear it; the password alone must not.
+	if !account.MFA.Enabled {
+		handler.lockout.Reset(ctx, lockoutKey)
+	}
+
+	if rehash {
+		handler.rehashPassword(ctx, account, user.Password)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte("poler"))
+	if handler.requireVerified && !account.EmailVerified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address is not verified"})
+		return
+	}
+
+	handler.completeSignIn(ctx, c, account)
+}
 
+// rehashPassword replaces an outdated password hash now that the password
+// is known. Failing to is logged; the old hash keeps working.
+func (handler *AuthHandler) rehashPassword(ctx context.Context, account models.User, password string) {
+	hash, err := hashPassword(password)
+	if err == nil {
+		// Matching the old hash leaves a password changed meanwhile alone.
+		_, err = handler.collection.UpdateOne(ctx,
+			bson.M{"_id": account.ID, "password": account.Password},
+			bson.M{"$set": bson.M{"password": hash}})
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		logging.FromContext(ctx).Warn("rehashing password failed", "error", err)
+	}
+}
+
+// completeSignIn answers a successful first factor with a JWT, or with an
+// MFA challenge when the user has 2FA enabled.
+func (handler *AuthHandler) completeSignIn(ctx context.Context, c *gin.Context, account models.User) {
+	if account.MFA.Enabled {
+		challenge, err := handler.challenge(ctx, account)
+		if dbTimeout(c, err) {
+			return
+		}
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, challenge)
 		return
 	}
 
-	JWTOutput := JWTOutput{
-		Token:   tokenString,
-		Expires: expirationTime,
+	JWTOutput, err := handler.sessions.issue(account)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
+	metrics.SignIns.Inc()
+
 	c.JSON(http.StatusOK, JWTOutput)
 }
 
 func (handler *AuthHandler) RefreshHandler(c *gin.Context) {
-	tokenValue := c.GetHeader("Authorization")
-	claims := &Claims{}
-
-	tkn, err := jwt.ParseWithClaims(tokenValue, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte("poler"), nil
-	})
+	claims, err := handler.sessions.parse(c.GetHeader("Authorization"))
 
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
 
-	if tkn == nil || !tkn.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid"})
-		return
-	}
-
-	if time.Unix(claims.ExpiresAt, 0).Sub(time.Now()) > 30*time.Second {
+	if time.Until(claims.ExpiresAt.Time) > 30*time.Second {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is not expired"})
 		return
 	}
 
-	expirationTime := time.Now().Add(5 * time.Minute)
-	claims.ExpiresAt = expirationTime.Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString("poler")
+	userID, _ := primitive.ObjectIDFromHex(claims.Subject)
+	jwtOutput, err := handler.sessions.issue(models.User{ID: userID, Email: claims.Email})
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	jwtOutput := JWTOutput{
-		Token:   tokenString,
-		Expires: expirationTime,
-	}
 	c.JSON(http.StatusOK, jwtOutput)
 }
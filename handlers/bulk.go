@@ -0,0 +1,388 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxBulk caps how many transactions one bulk request may touch.
+const maxBulk = 1000
+
+const (
+	BulkDeleted  = "deleted"
+	BulkUpdated  = "updated"
+	BulkNotFound = "not_found"
+	BulkFailed   = "failed"
+)
+
+type BulkHandler struct {
+	transactions *mongo.Collection
+	categories   *mongo.Collection
+	auditLog     *audit.Log
+	timeouts     Timeouts
+}
+
+type BulkItem struct {
+	ID     primitive.ObjectID `json:"id"`
+	Status string             `json:"status"`
+	Error  string             `json:"error,omitempty"`
+}
+
+type BulkResult struct {
+	Matched  int64      `json:"matched"`
+	Modified int64      `json:"modified"`
+	Deleted  int64      `json:"deleted"`
+	Items    []BulkItem `json:"items"`
+}
+
+var errBulkTooMany = errors.New("the filter matches too many transactions, narrow it down")
+
+func NewBulkHandler(timeouts Timeouts, transactions *mongo.Collection, categories *mongo.Collection, auditLog *audit.Log) *BulkHandler {
+	return &BulkHandler{
+		transactions: transactions,
+		categories:   categories,
+		auditLog:     auditLog,
+		timeouts:     timeouts,
+	}
+}
+
+// bulkFilter matches the selected ledger's transactions against filter.
+func bulkFilter(ledger primitive.ObjectID, filter models.BulkFilter) (bson.D, error) {
+	match := bson.D{{"ledger", ledger}, {"deletedAt", nil}}
+
+	dates := bson.D{}
+	for _, bound := range []struct{ value, op string }{{filter.From, "$gte"}, {filter.To, "$lte"}} {
+		if bound.value == "" {
+			continue
+		}
+		dt, err := time.Parse("2006-01-02", bound.value)
+		if err != nil {
+			return nil, errors.New("filter dates should be in YYYY-MM-DD format")
+		}
+		dates = append(dates, bson.E{bound.op, primitive.NewDateTimeFromTime(dt)})
+	}
+	if len(dates) > 0 {
+		match = append(match, bson.E{"invdt", dates})
+	}
+
+	amounts := bson.D{}
+	if filter.MinAmount != nil {
+		amounts = append(amounts, bson.E{"$gte", *filter.MinAmount})
+	}
+	if filter.MaxAmount != nil {
+		amounts = append(amounts, bson.E{"$lte", *filter.MaxAmount})
+	}
+	if len(amounts) > 0 {
+		match = append(match, bson.E{"amount", amounts})
+	}
+
+	if filter.Category != nil {
+		match = append(match, bson.E{"category", *filter.Category})
+	}
+	if filter.Tag != "" {
+		match = append(match, bson.E{"tags", filter.Tag})
+	}
+
+	return match, nil
+}
+
+// targets loads the transactions a bulk request applies to, also as
+// documents for the audit log. Listed IDs outside the selected ledger come
+// back as not found.
+func (handler *BulkHandler) targets(c *gin.Context, request models.BulkRequest, match bson.D) ([]models.Transaction, []bson.M, []BulkItem, error) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	cur, err := handler.transactions.Find(ctx, match, options.Find().SetLimit(maxBulk+1))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer cur.Close(ctx)
+
+	var transactions []models.Transaction
+	var docs []bson.M
+	for cur.Next(ctx) {
+		var transaction models.Transaction
+		var doc bson.M
+		if err := cur.Decode(&transaction); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return nil, nil, nil, err
+		}
+		transactions, docs = append(transactions, transaction), append(docs, doc)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(transactions) > maxBulk {
+		return nil, nil, nil, errBulkTooMany
+	}
+
+	found := map[primitive.ObjectID]bool{}
+	for _, transaction := range transactions {
+		found[transaction.ID] = true
+	}
+
+	missing := []BulkItem{}
+	for _, id := range request.IDs {
+		if !found[id] {
+			missing = append(missing, BulkItem{ID: id, Status: BulkNotFound})
+			found[id] = true
+		}
+	}
+
+	return transactions, docs, missing, nil
+}
+
+// writeModel builds the write for one transaction. Deletes are stamped
+// with now, which tells them apart from other deletes when read back.
+func writeModel(request models.BulkRequest, transaction models.Transaction, now time.Time) mongo.WriteModel {
+	filter := bson.M{"_id": transaction.ID, "deletedAt": nil}
+	inc := bson.E{"$inc", bson.D{{"version", 1}}}
+
+	switch request.Action {
+	case "delete":
+		return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(bson.D{{"$set", bson.D{{"deletedAt", now}}}, inc})
+	case "categorize":
+		update := bson.D{{"$unset", bson.D{{"category", ""}}}, inc}
+		if !request.ClearCategory {
+			update = bson.D{{"$set", bson.D{{"category", *request.Category}}}, inc}
+		}
+		return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update)
+	case "tag":
+		add, remove := request.AddTags, request.RemoveTags
+		if add == nil {
+			add = []string{}
+		}
+		if remove == nil {
+			remove = []string{}
+		}
+		// One pipeline stage so adding and removing do not conflict on tags.
+		return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(mongo.Pipeline{{{"$set", bson.D{
+			{"tags", bson.D{{"$setDifference", bson.A{
+				bson.D{{"$setUnion", bson.A{bson.D{{"$ifNull", bson.A{"$tags", bson.A{}}}}, add}}},
+				remove,
+			}}}},
+			{"version", bson.D{{"$add", bson.A{bson.D{{"$ifNull", bson.A{"$version", 0}}}, 1}}}},
+		}}}})
+	}
+
+	// shift-dates
+	dt := transaction.InvDt.Time().UTC()
+	if parsed, err := time.Parse("2006-01-02", transaction.Date); err == nil {
+		dt = parsed
+	}
+	dt = dt.AddDate(0, 0, request.Days)
+	return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(bson.D{
+		{"$set", bson.D{{"date", dt.Format("2006-01-02")}, {"invdt", primitive.NewDateTimeFromTime(dt)}}},
+		inc,
+	})
+}
+
+// BulkTransactions deletes, re-categorises, re-tags or shifts the dates of
+// many transactions in the selected ledger with a single unordered
+// BulkWrite, reporting the outcome for each transaction.
+func (handler *BulkHandler) BulkTransactions(c *gin.Context) {
+	var request models.BulkRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if (len(request.IDs) > 0) == (request.Filter != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Select transactions with either ids or filter"})
+		return
+	}
+
+	switch {
+	case request.Action == "tag" && len(request.AddTags) == 0 && len(request.RemoveTags) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "addTags or removeTags is required"})
+		return
+	case request.Action == "shift-dates" && request.Days == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days is required"})
+		return
+	case request.Action == "categorize" && (request.Category != nil) == request.ClearCategory:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either category or clearCategory is required"})
+		return
+	case request.Action == "categorize" && request.Category != nil:
+		if !handler.categoryExists(c, *request.Category) {
+			return
+		}
+	}
+
+	match := bson.D{{"ledger", ledgerOf(c).ID}, {"deletedAt", nil}, {"_id", bson.D{{"$in", request.IDs}}}}
+	if request.Filter != nil {
+		var err error
+		if match, err = bulkFilter(ledgerOf(c).ID, *request.Filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	transactions, before, items, err := handler.targets(c, request, match)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == errBulkTooMany {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := BulkResult{Items: items}
+	if len(transactions) == 0 {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	now := time.Now()
+	writes := make([]mongo.WriteModel, len(transactions))
+	for i, transaction := range transactions {
+		writes[i] = writeModel(request, transaction, now)
+	}
+
+	res, err := handler.transactions.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+
+	failed := map[int]string{}
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = writeErr.Message
+		}
+	} else {
+		if dbTimeout(c, err) {
+			return
+		}
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if res != nil {
+		result.Matched, result.Modified = res.MatchedCount, res.ModifiedCount
+		if request.Action == "delete" {
+			// Deletes move transactions to the trash, which is an update.
+			result.Deleted, result.Modified = res.ModifiedCount, 0
+		}
+	}
+
+	after, err := handler.readBack(ctx, transactions, failed)
+	if err != nil {
+		logging.FromContext(ctx).Error("reading back bulk transactions failed", "error", err)
+	}
+
+	applied := map[int]bool{}
+	for i, transaction := range transactions {
+		item := BulkItem{ID: transaction.ID, Status: BulkUpdated}
+		if message, ok := failed[i]; ok {
+			item.Status, item.Error = BulkFailed, message
+		} else if after != nil && !bulkApplied(request.Action, after[transaction.ID], now) {
+			// Deleted between targets and the write, which matched nothing.
+			item.Status = BulkNotFound
+		} else if request.Action == "delete" {
+			item.Status = BulkDeleted
+		}
+		applied[i] = item.Status != BulkFailed && item.Status != BulkNotFound
+		result.Items = append(result.Items, item)
+	}
+
+	if after != nil {
+		handler.record(ctx, c, request.Action, transactions, before, after, applied)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// readBack reads the documents after the bulk write in one query, keyed
+// by id. Transactions whose write failed are left out.
+func (handler *BulkHandler) readBack(ctx context.Context, transactions []models.Transaction, failed map[int]string) (map[primitive.ObjectID]bson.M, error) {
+	ids := []primitive.ObjectID{}
+	for i, transaction := range transactions {
+		if _, ok := failed[i]; !ok {
+			ids = append(ids, transaction.ID)
+		}
+	}
+
+	var docs []bson.M
+	cur, err := handler.transactions.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err == nil {
+		err = cur.All(ctx, &docs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	after := map[primitive.ObjectID]bson.M{}
+	for _, doc := range docs {
+		id, _ := doc["_id"].(primitive.ObjectID)
+		after[id] = doc
+	}
+
+	return after, nil
+}
+
+// bulkApplied reports whether the read back doc shows the bulk write
+// landed on it. Every write skips transactions in the trash, so one that
+// is in it now was deleted before the write, unless the write deleted it
+// at now.
+func bulkApplied(action string, doc bson.M, now time.Time) bool {
+	if doc == nil {
+		return false
+	}
+	deletedAt, _ := doc["deletedAt"].(primitive.DateTime)
+	if action == "delete" {
+		return deletedAt == primitive.NewDateTimeFromTime(now)
+	}
+	return doc["deletedAt"] == nil
+}
+
+// record adds an audit entry for each transaction the bulk write changed.
+// after holds the documents read back after the write; a write that
+// landed on one of them in the meantime shows up in its entry.
+func (handler *BulkHandler) record(ctx context.Context, c *gin.Context, action string, transactions []models.Transaction, before []bson.M, after map[primitive.ObjectID]bson.M, applied map[int]bool) {
+	auditAction := audit.Update
+	if action == "delete" {
+		auditAction = audit.Delete
+	}
+
+	for i, transaction := range transactions {
+		if doc, ok := after[transaction.ID]; ok && applied[i] {
+			changes := audit.Diff(audit.Transaction, before[i], doc)
+			if len(changes) > 0 {
+				record(ctx, c, handler.auditLog, audit.Transaction, transaction.ID, auditAction, changes)
+			}
+		}
+	}
+}
+
+func (handler *BulkHandler) categoryExists(c *gin.Context, id primitive.ObjectID) bool {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	return categoryInLedger(ctx, c, handler.categories, id)
+}
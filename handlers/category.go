@@ -1,193 +1,183 @@
 package handlers
 
 import (
+	"context"
+	"expense-tracker-api/audit"
+	"expense-tracker-api/migrations"
 	"expense-tracker-api/models"
-	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/net/context"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type CategoryHandler struct {
 	collection     *mongo.Collection
 	userCollection *mongo.Collection
-	ctx            context.Context
+	auditLog       *audit.Log
+	timeouts       Timeouts
 }
 
-func NewCategoryHandler(ctx context.Context, collection *mongo.Collection, usrCollection *mongo.Collection) *CategoryHandler {
+func NewCategoryHandler(timeouts Timeouts, collection *mongo.Collection, usrCollection *mongo.Collection, auditLog *audit.Log) *CategoryHandler {
 	return &CategoryHandler{
 		collection:     collection,
 		userCollection: usrCollection,
-		ctx:            ctx,
+		auditLog:       auditLog,
+		timeouts:       timeouts,
 	}
 }
 
 func (handler *CategoryHandler) ListCategory(c *gin.Context) {
-	// var pipeline monongo.pipeline
-	var user models.User
-	email := c.MustGet("email")
-	userErr := handler.userCollection.FindOne(handler.ctx, bson.M{
-		"email": email,
-	}).Decode(&user)
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
 
-	if userErr != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"user": userErr.Error()})
-		return
-	}
+	ledger := ledgerOf(c)
 
 	// TODO: remove owner from response
 	pipeline := mongo.Pipeline{
 		{{"$match", bson.D{
-			{"owner", bson.D{
-				{"$eq", user.ID},
+			{"ledger", bson.D{
+				{"$eq", ledger.ID},
 			},
 			},
+			{"deletedAt", nil},
 		}}},
 	}
 
-	cur, err := handler.collection.Aggregate(handler.ctx, pipeline)
+	cur, err := handler.collection.Aggregate(ctx, pipeline)
+
+	if dbTimeout(c, err) {
+		return
+	}
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	defer cur.Close(handler.ctx)
+	defer cur.Close(ctx)
 	categories := make([]models.Category, 0)
 
-	for cur.Next(handler.ctx) {
+	for cur.Next(ctx) {
 		var category models.Category
 		cur.Decode(&category)
 		categories = append(categories, category)
 	}
 
+	if dbTimeout(c, cur.Err()) {
+		return
+	}
+
 	c.JSON(http.StatusOK, categories)
 }
 
 func (handler *CategoryHandler) CreateCategory(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
 	var category models.Category
-	var user models.User
-	email := c.MustGet("email")
 
 	if err := c.ShouldBindJSON(&category); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	userErr := handler.userCollection.FindOne(handler.ctx, bson.M{
-		"email": email,
-	}).Decode(&user)
-
-	if userErr != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"user": userErr.Error()})
-		return
-	}
+	principal := principalOf(c)
 
-	pipeline := mongo.Pipeline{
-		{{"$match", bson.D{
-			{"owner", bson.D{
-				{"$eq", user.ID},
-			},
-			},
-			{"name", bson.D{
-				{"$eq", category.Name},
-			},
-			},
-		}}},
-	}
+	category.ID = primitive.NewObjectID()
+	category.Owner = principal.UserID
+	category.Ledger = ledgerOf(c).ID
+	category.DeletedAt = nil
+	category.Version = 1
+	createdCategory, err := handler.collection.InsertOne(ctx, category)
 
-	if userErr != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"user": userErr.Error()})
+	if dbTimeout(c, err) {
 		return
 	}
 
-	cur, caregoryErr := handler.collection.Aggregate(handler.ctx, pipeline)
-	log.Print(caregoryErr)
-
-	defer cur.Close(handler.ctx)
-	categories := make([]models.Category, 0)
-
-	for cur.Next(handler.ctx) {
-		var category models.Category
-		cur.Decode(&category)
-		categories = append(categories, category)
-	}
-	log.Print(len(categories))
-
-	if len(categories) > 0 {
+	if duplicateKey(err, migrations.CategoriesLiveNameIndex) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"Category": "Category alredy exists"})
 		return
 	}
 
-	category.ID = primitive.NewObjectID()
-	category.Owner = user.ID
-	createdCategory, err := handler.collection.InsertOne(handler.ctx, category)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error while creating new category"})
+		return
+	}
 
-	_, updateErr := handler.userCollection.UpdateOne(handler.ctx, bson.M{
-		"email": email,
+	_, updateErr := handler.userCollection.UpdateOne(ctx, bson.M{
+		"_id": principal.UserID,
 	}, bson.D{{"$push", bson.D{
 		{"categories", createdCategory.InsertedID},
 	}}})
 
-	if updateErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": updateErr.Error()})
+	if dbTimeout(c, updateErr) {
 		return
 	}
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error while creating new category"})
+	if updateErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": updateErr.Error()})
 		return
 	}
 
+	recordCreate(ctx, c, handler.auditLog, audit.Category, category.ID, category)
+	setETag(c, category.Version)
 	c.JSON(http.StatusOK, category)
 }
 
 func (handler *CategoryHandler) GetCategory(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
 	var category models.Category
 
 	id := c.Param("id")
 	objectId, _ := primitive.ObjectIDFromHex(id)
 
-	err := handler.collection.FindOne(handler.ctx, bson.D{{"_id", objectId}}).Decode(&category)
+	err := handler.collection.FindOne(ctx, bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil}).Decode(&category)
+	if dbTimeout(c, err) {
+		return
+	}
+
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
 		return
 	}
 
+	setETag(c, category.Version)
 	c.JSON(http.StatusOK, category)
 }
 
 func (handler *CategoryHandler) DeleteCategory(c *gin.Context) {
-	email := c.MustGet("email")
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
 	id := c.Param("id")
 	objectId, _ := primitive.ObjectIDFromHex(id)
 
-	_, err := handler.collection.DeleteOne(handler.ctx, bson.D{{"_id", objectId}})
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
-		return
-	}
-
-	_, updateErr := handler.userCollection.UpdateOne(handler.ctx, bson.M{
-		"email": email,
-	}, bson.D{{"$pull", bson.D{
-		{"categories", objectId},
-	}}})
+	// Deleted categories go to the trash until Trash purges them.
+	var category models.Category
+	before, after, err := versionedUpdate(ctx, c, handler.collection, bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil},
+		bson.D{{"$set", bson.D{{"deletedAt", time.Now()}}}}, &category)
 
-	if updateErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": updateErr.Error()})
+	if handler.updateFailed(c, err) {
 		return
 	}
 
+	record(ctx, c, handler.auditLog, audit.Category, objectId, audit.Delete, audit.Diff(audit.Category, before, after))
 	c.JSON(http.StatusOK, gin.H{"message": "Category successfully removed"})
 }
 
 func (handler *CategoryHandler) UpdateCategory(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
 	var category models.Category
+	var updated models.Category
 	id := c.Param("id")
 
 	if err := c.ShouldBindJSON(&category); err != nil {
@@ -196,18 +186,117 @@ func (handler *CategoryHandler) UpdateCategory(c *gin.Context) {
 	}
 
 	objectId, _ := primitive.ObjectIDFromHex(id)
-	_, err := handler.collection.UpdateOne(handler.ctx, bson.M{
-		"_id": objectId,
-	}, bson.D{{"$set", bson.D{
+	before, after, err := versionedUpdate(ctx, c, handler.collection, bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil}, bson.D{{"$set", bson.D{
 		{"name", category.Name},
 		{"type", category.Type},
 		{"color", category.Color},
-	}}})
+		{"budget", category.Budget},
+	}}}, &updated)
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if handler.updateFailed(c, err) {
 		return
 	}
 
+	record(ctx, c, handler.auditLog, audit.Category, objectId, audit.Update, audit.Diff(audit.Category, before, after))
+
+	setETag(c, updated.Version)
 	c.JSON(http.StatusOK, gin.H{"message": "Category was successfully updated"})
 }
+
+var categoryPatchFields = map[string]patchField{
+	"name":   stringField("name", 1, 0),
+	"type":   stringField("type", 1, 0),
+	"color":  stringField("color", 0, 0).optional(),
+	"budget": nonNegativeIntField("budget").optional(),
+}
+
+func (handler *CategoryHandler) PatchCategory(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var body map[string]interface{}
+	var category models.Category
+	id := c.Param("id")
+
+	if ct := c.ContentType(); ct != mergePatchContentType && ct != gin.MIMEJSON {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Use " + mergePatchContentType})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	update, err := buildPatch(body, categoryPatchFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	objectId, _ := primitive.ObjectIDFromHex(id)
+	before, after, err := versionedUpdate(ctx, c, handler.collection, bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil}, update, &category)
+
+	if handler.updateFailed(c, err) {
+		return
+	}
+
+	record(ctx, c, handler.auditLog, audit.Category, objectId, audit.Update, audit.Diff(audit.Category, before, after))
+
+	setETag(c, category.Version)
+	c.JSON(http.StatusOK, category)
+}
+
+func (handler *CategoryHandler) updateFailed(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case dbTimeout(c, err):
+	case duplicateKey(err, migrations.CategoriesLiveNameIndex):
+		c.JSON(http.StatusConflict, gin.H{"error": "Category alredy exists"})
+	case err == mongo.ErrNoDocuments:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+	case err == errPreconditionFailed:
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case err == errConcurrentUpdate:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return true
+}
+
+// categoryInLedger reports whether id is a category of the selected ledger
+// that is not in the trash, writing the response when it is not.
+func categoryInLedger(ctx context.Context, c *gin.Context, categories *mongo.Collection, id primitive.ObjectID) bool {
+	err := categories.FindOne(ctx, bson.M{"_id": id, "ledger": ledgerOf(c).ID, "deletedAt": nil},
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+
+	if dbTimeout(c, err) {
+		return false
+	}
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Category not found"})
+		return false
+	}
+
+	return true
+}
+
+// categoryLookup joins the category that localField refers to into as.
+// Only categories of ledger are joined, so an id taken from another ledger
+// resolves to nothing.
+func categoryLookup(ledger primitive.ObjectID, localField string, as string) bson.D {
+	return bson.D{{"$lookup", bson.D{
+		{"from", "categories"},
+		{"let", bson.D{{"category", "$" + localField}}},
+		{"pipeline", bson.A{
+			bson.D{{"$match", bson.D{{"$expr", bson.D{{"$and", bson.A{
+				bson.D{{"$eq", bson.A{"$_id", "$$category"}}},
+				bson.D{{"$eq", bson.A{"$ledger", ledger}}},
+			}}}}}}},
+		}},
+		{"as", as},
+	}}}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errPreconditionFailed = errors.New("resource was modified, reload it and retry")
+
+var errConcurrentUpdate = errors.New("resource is being modified by another request, retry")
+
+// maxUpdateAttempts bounds how often versionedUpdate retries when other
+// writes keep replacing the version it read.
+const maxUpdateAttempts = 3
+
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+func setETag(c *gin.Context, version int) {
+	c.Header("ETag", etag(version))
+}
+
+// ifMatchFilter turns the If-Match header into a condition on the version
+// field. Documents written before versioning have no version and match "0".
+func ifMatchFilter(c *gin.Context) (bson.M, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		return nil, false
+	}
+
+	if header == "*" {
+		return bson.M{}, true
+	}
+
+	versions := bson.A{}
+	for _, tag := range strings.Split(header, ",") {
+		value, err := strconv.Unquote(strings.TrimSpace(tag))
+		if err != nil {
+			continue
+		}
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+		if version == 0 {
+			versions = append(versions, nil)
+		}
+	}
+
+	return bson.M{"version": bson.M{"$in": versions}}, true
+}
+
+// versionedUpdate applies update to the document matching match and
+// increments its version, decoding the updated document into out. When
+// If-Match is sent and the stored version differs it returns
+// errPreconditionFailed.
+//
+// It also returns the document before and after the update for the audit
+// log. The write is pinned to the version read first, and retried when
+// another write got in between, so the two differ by exactly this update.
+func versionedUpdate(ctx context.Context, c *gin.Context, collection *mongo.Collection, match bson.M, update bson.D, out interface{}) (bson.M, bson.M, error) {
+	filter := bson.M{}
+	for k, v := range match {
+		filter[k] = v
+	}
+	condition, conditional := ifMatchFilter(c)
+	for k, v := range condition {
+		filter[k] = v
+	}
+
+	update = append(update, bson.E{"$inc", bson.D{{"version", 1}}})
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var before bson.M
+		err := collection.FindOne(ctx, filter).Decode(&before)
+
+		if err == mongo.ErrNoDocuments && conditional {
+			count, countErr := collection.CountDocuments(ctx, match)
+			if countErr != nil {
+				return nil, nil, countErr
+			}
+			if count > 0 {
+				return nil, nil, errPreconditionFailed
+			}
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pinned := bson.M{}
+		for k, v := range filter {
+			pinned[k] = v
+		}
+		pinned["_id"], pinned["version"] = before["_id"], before["version"]
+
+		var raw bson.Raw
+		err = collection.FindOneAndUpdate(ctx, pinned, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&raw)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var after bson.M
+		if err := bson.Unmarshal(raw, &after); err != nil {
+			return nil, nil, err
+		}
+		return before, after, bson.Unmarshal(raw, out)
+	}
+
+	return nil, nil, errConcurrentUpdate
+}
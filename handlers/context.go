@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// statusClientClosedRequest is reported when the client went away before
+// the database call finished, following the nginx convention.
+const statusClientClosedRequest = 499
+
+// Timeouts bound every database call a handler makes. The contexts derive
+// from the request so a disconnecting client also cancels the query.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+func (timeouts Timeouts) read(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), timeouts.Read)
+}
+
+func (timeouts Timeouts) write(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), timeouts.Write)
+}
+
+// dbTimeout answers 504 when err comes from an exceeded deadline and
+// reports whether the response was written.
+func dbTimeout(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": "Database operation timed out"})
+		return true
+	case errors.Is(err, context.Canceled):
+		c.AbortWithStatus(statusClientClosedRequest)
+		return true
+	}
+	return false
+}
+
+// duplicateKey reports whether err violates the unique index with the
+// given name.
+func duplicateKey(err error, index string) bool {
+	return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), index)
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"expense-tracker-api/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultDashboardTop    = 5
+	defaultDashboardLatest = 5
+	maxDashboardList       = 50
+)
+
+// Totals leave out settlements, which move money between members rather
+// than earn or spend it.
+type Totals struct {
+	Income  int `json:"income"`
+	Expense int `json:"expense"`
+	Net     int `json:"net"`
+}
+
+// TotalsChange compares a period with the one before. The percentages are
+// left out when the previous value was 0.
+type TotalsChange struct {
+	Income         int      `json:"income"`
+	Expense        int      `json:"expense"`
+	Net            int      `json:"net"`
+	IncomePercent  *float64 `json:"incomePercent,omitempty"`
+	ExpensePercent *float64 `json:"expensePercent,omitempty"`
+}
+
+// CategorySpending is what went to one category, with its share of the
+// period's expense. Uncategorised spending has no category.
+type CategorySpending struct {
+	Category *primitive.ObjectID `json:"category,omitempty"`
+	Name     string              `json:"name"`
+	Color    string              `json:"color,omitempty"`
+	Total    int                 `json:"total"`
+	Count    int                 `json:"count"`
+	Share    float64             `json:"share"`
+}
+
+type BudgetStatus struct {
+	Category  primitive.ObjectID `json:"category"`
+	Name      string             `json:"name"`
+	Budget    int                `json:"budget"`
+	Spent     int                `json:"spent"`
+	Remaining int                `json:"remaining"`
+	Percent   float64            `json:"percent"`
+	Over      bool               `json:"over"`
+}
+
+type Dashboard struct {
+	Month         string               `json:"month"`
+	Current       Totals               `json:"current"`
+	Previous      Totals               `json:"previous"`
+	Change        TotalsChange         `json:"change"`
+	TopCategories []CategorySpending   `json:"topCategories"`
+	Budgets       []BudgetStatus       `json:"budgets"`
+	Latest        []models.Transaction `json:"latest"`
+}
+
+// dashboardFacets is the shape of the single document the dashboard
+// aggregation returns.
+type dashboardFacets struct {
+	Totals []struct {
+		ID struct {
+			Current bool `bson:"current"`
+			Income  bool `bson:"income"`
+		} `bson:"_id"`
+		Total int `bson:"total"`
+	} `bson:"totals"`
+	Categories []struct {
+		ID       *primitive.ObjectID `bson:"_id"`
+		Total    int                 `bson:"total"`
+		Count    int                 `bson:"count"`
+		Category []models.Category   `bson:"category"`
+	} `bson:"categories"`
+	Latest []models.Transaction `bson:"latest"`
+}
+
+func percentOf(part int, whole int) float64 {
+	return math.Round(float64(part)*1000/float64(whole)) / 10
+}
+
+func percentChange(current int, previous int) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	value := percentOf(current-previous, previous)
+	return &value
+}
+
+func dashboardLimit(c *gin.Context, name string, fallback int) (int, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, true
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 || limit > maxDashboardList {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " should be between 0 and " + strconv.Itoa(maxDashboardList)})
+		return 0, false
+	}
+	return limit, true
+}
+
+// GetDashboard summarises a month of the selected ledger, the current one
+// unless month=YYYY-MM is given: income, expense and net against the month
+// before, the top spending categories, budget status and the latest
+// transactions. The figures come from one aggregation over transactions,
+// split into $facet branches; the budgets are read from categories.
+func (handler *TransactionHandler) GetDashboard(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if month := c.Query("month"); month != "" {
+		parsed, err := time.Parse("2006-01", month)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "month should be in YYYY-MM format"})
+			return
+		}
+		start = parsed
+	}
+	end := start.AddDate(0, 1, 0)
+	previous := start.AddDate(0, -1, 0)
+
+	top, ok := dashboardLimit(c, "top", defaultDashboardTop)
+	if !ok {
+		return
+	}
+	latest, ok := dashboardLimit(c, "latest", defaultDashboardLatest)
+	if !ok {
+		return
+	}
+
+	ledger := ledgerOf(c).ID
+	notSettlement := bson.E{"type", bson.D{{"$ne", models.TransactionSettlement}}}
+	month := bson.D{{"$gte", primitive.NewDateTimeFromTime(start)}, {"$lt", primitive.NewDateTimeFromTime(end)}}
+	lookupCategory := categoryLookup(ledger, "category", "cat")
+
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"ledger", ledger}, {"deletedAt", nil}}}},
+		{{"$facet", bson.D{
+			{"totals", bson.A{
+				bson.D{{"$match", bson.D{notSettlement, {"invdt", bson.D{
+					{"$gte", primitive.NewDateTimeFromTime(previous)},
+					{"$lt", primitive.NewDateTimeFromTime(end)},
+				}}}}},
+				lookupCategory,
+				bson.D{{"$group", bson.D{
+					{"_id", bson.D{
+						{"current", bson.D{{"$gte", bson.A{"$invdt", primitive.NewDateTimeFromTime(start)}}}},
+						{"income", bson.D{{"$eq", bson.A{bson.D{{"$arrayElemAt", bson.A{"$cat.type", 0}}}, models.CategoryIncome}}}},
+					}},
+					{"total", bson.D{{"$sum", "$amount"}}},
+				}}},
+			}},
+			{"categories", bson.A{
+				bson.D{{"$match", bson.D{notSettlement, {"invdt", month}}}},
+				bson.D{{"$group", bson.D{
+					{"_id", "$category"},
+					{"total", bson.D{{"$sum", "$amount"}}},
+					{"count", bson.D{{"$sum", 1}}},
+				}}},
+				categoryLookup(ledger, "_id", "category"),
+				bson.D{{"$sort", bson.D{{"total", -1}, {"_id", 1}}}},
+			}},
+			{"latest", bson.A{
+				bson.D{{"$sort", bson.D{{"invdt", -1}, {"_id", -1}}}},
+				// $limit must be positive; buildDashboard trims the extra one.
+				bson.D{{"$limit", latest + 1}},
+				lookupCategory,
+			}},
+		}}},
+	}
+
+	cur, err := handler.collection.Aggregate(ctx, pipeline)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var facets []dashboardFacets
+	if err := cur.All(ctx, &facets); err != nil {
+		if dbTimeout(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var result dashboardFacets
+	if len(facets) > 0 {
+		result = facets[0]
+	}
+
+	// Budgets are read from the categories themselves, so every one comes
+	// back even when nothing was spent in it or in the whole ledger.
+	budgets := []models.Category{}
+	cur, err = handler.categories.Find(ctx, bson.M{"ledger": ledger, "deletedAt": nil, "budget": bson.M{"$gt": 0}},
+		options.Find().SetSort(bson.D{{"name", 1}}))
+	if err == nil {
+		err = cur.All(ctx, &budgets)
+	}
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, buildDashboard(start, result, budgets, top, latest))
+}
+
+func buildDashboard(start time.Time, facets dashboardFacets, budgets []models.Category, top int, latest int) Dashboard {
+	dashboard := Dashboard{
+		Month:         start.Format("2006-01"),
+		TopCategories: []CategorySpending{},
+		Budgets:       []BudgetStatus{},
+		Latest:        facets.Latest,
+	}
+
+	for _, total := range facets.Totals {
+		totals := &dashboard.Previous
+		if total.ID.Current {
+			totals = &dashboard.Current
+		}
+		if total.ID.Income {
+			totals.Income += total.Total
+		} else {
+			totals.Expense += total.Total
+		}
+	}
+
+	for _, totals := range []*Totals{&dashboard.Current, &dashboard.Previous} {
+		totals.Net = totals.Income - totals.Expense
+	}
+
+	dashboard.Change = TotalsChange{
+		Income:         dashboard.Current.Income - dashboard.Previous.Income,
+		Expense:        dashboard.Current.Expense - dashboard.Previous.Expense,
+		Net:            dashboard.Current.Net - dashboard.Previous.Net,
+		IncomePercent:  percentChange(dashboard.Current.Income, dashboard.Previous.Income),
+		ExpensePercent: percentChange(dashboard.Current.Expense, dashboard.Previous.Expense),
+	}
+
+	spent := map[primitive.ObjectID]int{}
+	for _, group := range facets.Categories {
+		spending := CategorySpending{Category: group.ID, Name: "Uncategorised", Total: group.Total, Count: group.Count}
+		if len(group.Category) > 0 {
+			category := group.Category[0]
+			if category.Type == models.CategoryIncome {
+				continue
+			}
+			spending.Name, spending.Color = category.Name, category.Color
+			spent[category.ID] = group.Total
+		}
+
+		if dashboard.Current.Expense > 0 {
+			spending.Share = percentOf(spending.Total, dashboard.Current.Expense)
+		}
+		if len(dashboard.TopCategories) < top {
+			dashboard.TopCategories = append(dashboard.TopCategories, spending)
+		}
+	}
+
+	for _, category := range budgets {
+		dashboard.Budgets = append(dashboard.Budgets, BudgetStatus{
+			Category:  category.ID,
+			Name:      category.Name,
+			Budget:    category.Budget,
+			Spent:     spent[category.ID],
+			Remaining: category.Budget - spent[category.ID],
+			Percent:   percentOf(spent[category.ID], category.Budget),
+			Over:      spent[category.ID] > category.Budget,
+		})
+	}
+
+	if dashboard.Latest == nil {
+		dashboard.Latest = []models.Transaction{}
+	}
+	if len(dashboard.Latest) > latest {
+		dashboard.Latest = dashboard.Latest[:latest]
+	}
+
+	return dashboard
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+type HealthHandler struct {
+	client   *mongo.Client
+	draining atomic.Bool
+}
+
+func NewHealthHandler(client *mongo.Client) *HealthHandler {
+	return &HealthHandler{
+		client: client,
+	}
+}
+
+// Drain makes the readiness probe fail so load balancers stop routing
+// new requests while in-flight ones finish.
+func (handler *HealthHandler) Drain() {
+	handler.draining.Store(true)
+}
+
+func (handler *HealthHandler) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (handler *HealthHandler) Readyz(c *gin.Context) {
+	if handler.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := handler.client.Ping(ctx, readpref.Primary()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "mongo": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "mongo": "ok"})
+}
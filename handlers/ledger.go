@@ -0,0 +1,632 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"expense-tracker-api/ledgers"
+	"expense-tracker-api/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LedgerHeader selects the ledger a request works on. Without it the
+// caller's personal ledger is used.
+const LedgerHeader = "X-Ledger-ID"
+
+const invitationTTL = 7 * 24 * time.Hour
+
+type LedgerHandler struct {
+	collection   *mongo.Collection
+	invitations  *mongo.Collection
+	categories   *mongo.Collection
+	transactions *mongo.Collection
+	attachments  *AttachmentHandler
+	baseURL      string
+	timeouts     Timeouts
+}
+
+// LedgerAccess is the ledger a request is scoped to and the caller's role
+// in it.
+type LedgerAccess struct {
+	ID      primitive.ObjectID
+	Role    string
+	Members []primitive.ObjectID
+}
+
+func (access LedgerAccess) member(userID primitive.ObjectID) bool {
+	for _, member := range access.Members {
+		if member == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatedInvitation carries the link, which is shown only once.
+type CreatedInvitation struct {
+	models.Invitation
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+const ledgerKey = "ledger"
+
+func ledgerOf(c *gin.Context) LedgerAccess {
+	return c.MustGet(ledgerKey).(LedgerAccess)
+}
+
+func NewLedgerHandler(timeouts Timeouts, collection *mongo.Collection, invitations *mongo.Collection, categories *mongo.Collection, transactions *mongo.Collection, attachments *AttachmentHandler, baseURL string) *LedgerHandler {
+	return &LedgerHandler{
+		collection:   collection,
+		invitations:  invitations,
+		categories:   categories,
+		transactions: transactions,
+		attachments:  attachments,
+		baseURL:      baseURL,
+		timeouts:     timeouts,
+	}
+}
+
+func memberRole(ledger models.Ledger, userID primitive.ObjectID) (string, bool) {
+	for _, member := range ledger.Members {
+		if member.User == userID {
+			return member.Role, true
+		}
+	}
+	return "", false
+}
+
+func countOwners(ledger models.Ledger) int {
+	owners := 0
+	for _, member := range ledger.Members {
+		if member.Role == ledgers.Owner {
+			owners++
+		}
+	}
+	return owners
+}
+
+// Scope resolves the ledger named by LedgerHeader, or the personal one,
+// and requires the caller to hold at least role in it. It runs after
+// AuthMiddleware.
+func (handler *LedgerHandler) Scope(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := handler.timeouts.read(c)
+		defer cancel()
+
+		principal := principalOf(c)
+		header := c.GetHeader(LedgerHeader)
+
+		if header == "" {
+			id, err := ledgers.Personal(ctx, handler.collection, principal.UserID)
+			if err == mongo.ErrNoDocuments {
+				// Creating it when the user was created failed.
+				id, err = ledgers.EnsurePersonal(ctx, handler.collection, principal.UserID)
+			}
+			if dbTimeout(c, err) {
+				return
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.Set(ledgerKey, LedgerAccess{ID: id, Role: ledgers.Owner, Members: []primitive.ObjectID{principal.UserID}})
+			c.Next()
+			return
+		}
+
+		id, err := primitive.ObjectIDFromHex(header)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": LedgerHeader + " is not a valid id"})
+			return
+		}
+
+		ledger, ok := handler.find(c, id)
+		if !ok {
+			return
+		}
+
+		access, _ := memberRole(ledger, principal.UserID)
+		if !ledgers.Allows(access, role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This needs the " + role + " role in the ledger"})
+			return
+		}
+
+		members := make([]primitive.ObjectID, len(ledger.Members))
+		for i, member := range ledger.Members {
+			members[i] = member.User
+		}
+
+		c.Set(ledgerKey, LedgerAccess{ID: ledger.ID, Role: access, Members: members})
+		c.Next()
+	}
+}
+
+// find loads a ledger the caller is a member of. When there is none it
+// writes the response and returns false.
+func (handler *LedgerHandler) find(c *gin.Context, id primitive.ObjectID) (models.Ledger, bool) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	var ledger models.Ledger
+	err := handler.collection.FindOne(ctx, bson.M{"_id": id, "members.user": principalOf(c).UserID}).Decode(&ledger)
+
+	if dbTimeout(c, err) {
+		return ledger, false
+	}
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Ledger not found"})
+		return ledger, false
+	}
+
+	return ledger, true
+}
+
+// owned loads the ledger in the :id parameter and requires the caller to
+// own it.
+func (handler *LedgerHandler) owned(c *gin.Context) (models.Ledger, bool) {
+	id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	ledger, ok := handler.find(c, id)
+	if !ok {
+		return ledger, false
+	}
+
+	if role, _ := memberRole(ledger, principalOf(c).UserID); role != ledgers.Owner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only ledger owners can do this"})
+		return ledger, false
+	}
+
+	return ledger, true
+}
+
+func (handler *LedgerHandler) ListLedgers(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	principal := principalOf(c)
+
+	cur, err := handler.collection.Find(ctx, bson.M{"members.user": principal.UserID},
+		options.Find().SetSort(bson.D{{"personal", -1}, {"createdAt", 1}}))
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	defer cur.Close(ctx)
+	result := make([]models.Ledger, 0)
+
+	for cur.Next(ctx) {
+		var ledger models.Ledger
+		cur.Decode(&ledger)
+		result = append(result, ledger)
+	}
+
+	if dbTimeout(c, cur.Err()) {
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (handler *LedgerHandler) CreateLedger(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.LedgerRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	principal := principalOf(c)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ledger := models.Ledger{
+		ID:        primitive.NewObjectID(),
+		Name:      request.Name,
+		Owner:     principal.UserID,
+		Members:   []models.LedgerMember{{User: principal.UserID, Role: ledgers.Owner, JoinedAt: now}},
+		CreatedAt: now,
+	}
+
+	_, err := handler.collection.InsertOne(ctx, ledger)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ledger)
+}
+
+func (handler *LedgerHandler) GetLedger(c *gin.Context) {
+	id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	ledger, ok := handler.find(c, id)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, ledger)
+}
+
+func (handler *LedgerHandler) RenameLedger(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.LedgerRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ledger, ok := handler.owned(c)
+	if !ok {
+		return
+	}
+
+	_, err := handler.collection.UpdateOne(ctx, bson.M{"_id": ledger.ID}, bson.M{"$set": bson.M{"name": request.Name}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ledger.Name = request.Name
+	c.JSON(http.StatusOK, ledger)
+}
+
+// DeleteLedger removes a shared ledger with its categories and
+// transactions.
+func (handler *LedgerHandler) DeleteLedger(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	ledger, ok := handler.owned(c)
+	if !ok {
+		return
+	}
+
+	if ledger.Personal {
+		c.JSON(http.StatusConflict, gin.H{"error": "The personal ledger can not be deleted"})
+		return
+	}
+
+	err := handler.removeData(ctx, ledger.ID)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = handler.collection.DeleteOne(ctx, bson.M{"_id": ledger.ID})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Ledger successfully removed"})
+}
+
+// SetMemberRole changes a member's role. A ledger always keeps at least
+// one owner.
+func (handler *LedgerHandler) SetMemberRole(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.MemberRoleRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ledger, ok := handler.owned(c)
+	if !ok {
+		return
+	}
+
+	userID, _ := primitive.ObjectIDFromHex(c.Param("userId"))
+	current, member := memberRole(ledger, userID)
+	if !member {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+
+	if current == ledgers.Owner && request.Role != ledgers.Owner && countOwners(ledger) == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A ledger needs at least one owner"})
+		return
+	}
+
+	_, err := handler.collection.UpdateOne(ctx, bson.M{"_id": ledger.ID, "members.user": userID},
+		bson.M{"$set": bson.M{"members.$.role": request.Role}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member role updated"})
+}
+
+// RemoveMember lets owners remove anyone and members remove themselves.
+func (handler *LedgerHandler) RemoveMember(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	ledger, ok := handler.find(c, id)
+	if !ok {
+		return
+	}
+
+	principal := principalOf(c)
+	userID, _ := primitive.ObjectIDFromHex(c.Param("userId"))
+
+	if caller, _ := memberRole(ledger, principal.UserID); caller != ledgers.Owner && userID != principal.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only ledger owners can do this"})
+		return
+	}
+
+	role, member := memberRole(ledger, userID)
+	if !member {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+
+	if ledger.Personal {
+		c.JSON(http.StatusConflict, gin.H{"error": "The personal ledger can not be left"})
+		return
+	}
+
+	if role == ledgers.Owner && countOwners(ledger) == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A ledger needs at least one owner"})
+		return
+	}
+
+	_, err := handler.collection.UpdateOne(ctx, bson.M{"_id": ledger.ID},
+		bson.M{"$pull": bson.M{"members": bson.M{"user": userID}}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+func hashInvitation(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (handler *LedgerHandler) CreateInvitation(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.InvitationRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ledger, ok := handler.owned(c)
+	if !ok {
+		return
+	}
+
+	if ledger.Personal {
+		c.JSON(http.StatusConflict, gin.H{"error": "The personal ledger can not be shared"})
+		return
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	invitation := models.Invitation{
+		ID:        primitive.NewObjectID(),
+		Ledger:    ledger.ID,
+		Role:      request.Role,
+		Hash:      hashInvitation(token),
+		CreatedBy: principalOf(c).UserID,
+		ExpiresAt: time.Now().Add(invitationTTL).UTC().Truncate(time.Millisecond),
+	}
+
+	_, err := handler.invitations.InsertOne(ctx, invitation)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreatedInvitation{
+		Invitation: invitation,
+		Token:      token,
+		URL:        handler.baseURL + "/invitations/" + token,
+	})
+}
+
+// AcceptInvitation adds the caller to the invitation's ledger. Accepting
+// spends the invitation; members keep their current role.
+func (handler *LedgerHandler) AcceptInvitation(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	principal := principalOf(c)
+
+	var invitation models.Invitation
+	err := handler.invitations.FindOneAndUpdate(ctx, bson.M{
+		"hash":       hashInvitation(c.Param("token")),
+		"acceptedBy": bson.M{"$exists": false},
+		"expiresAt":  bson.M{"$gt": time.Now()},
+	}, bson.M{"$set": bson.M{"acceptedBy": principal.UserID}}).Decode(&invitation)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation is invalid, expired or already used"})
+		return
+	}
+
+	res, err := handler.collection.UpdateOne(ctx, bson.M{
+		"_id":          invitation.Ledger,
+		"members.user": bson.M{"$ne": principal.UserID},
+	}, bson.M{"$push": bson.M{"members": models.LedgerMember{
+		User:     principal.UserID,
+		Role:     invitation.Role,
+		JoinedAt: time.Now(),
+	}}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if res.MatchedCount == 0 {
+		handler.notJoined(ctx, c, invitation, principal.UserID)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ledger": invitation.Ledger})
+}
+
+// notJoined answers an accepted invitation that did not add userID to the
+// ledger, because they are a member already or the ledger is gone, and
+// leaves the invitation unused.
+func (handler *LedgerHandler) notJoined(ctx context.Context, c *gin.Context, invitation models.Invitation, userID primitive.ObjectID) {
+	_, err := handler.invitations.UpdateOne(ctx, bson.M{"_id": invitation.ID, "acceptedBy": userID},
+		bson.M{"$unset": bson.M{"acceptedBy": ""}})
+
+	var count int64
+	if err == nil {
+		count, err = handler.collection.CountDocuments(ctx, bson.M{"_id": invitation.Ledger})
+	}
+
+	switch {
+	case dbTimeout(c, err):
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case count > 0:
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already a member of this ledger"})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ledger not found"})
+	}
+}
+
+var errSoleOwner = errors.New("transfer ownership of your shared ledgers first")
+
+// removeMember takes userID out of every ledger before the account goes
+// away. Ledgers nobody else uses are deleted with their data; shared ones
+// keep what the user recorded.
+func (handler *LedgerHandler) removeMember(ctx context.Context, userID primitive.ObjectID) error {
+	cur, err := handler.collection.Find(ctx, bson.M{"members.user": userID})
+	if err != nil {
+		return err
+	}
+
+	var memberOf []models.Ledger
+	if err := cur.All(ctx, &memberOf); err != nil {
+		return err
+	}
+
+	for _, ledger := range memberOf {
+		role, _ := memberRole(ledger, userID)
+		if len(ledger.Members) > 1 && role == ledgers.Owner && countOwners(ledger) == 1 {
+			return errSoleOwner
+		}
+	}
+
+	for _, ledger := range memberOf {
+		if len(ledger.Members) > 1 {
+			_, err := handler.collection.UpdateOne(ctx, bson.M{"_id": ledger.ID},
+				bson.M{"$pull": bson.M{"members": bson.M{"user": userID}}})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := handler.removeData(ctx, ledger.ID); err != nil {
+			return err
+		}
+
+		if _, err := handler.collection.DeleteOne(ctx, bson.M{"_id": ledger.ID}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeData deletes everything recorded in a ledger ahead of the ledger
+// itself.
+func (handler *LedgerHandler) removeData(ctx context.Context, ledgerID primitive.ObjectID) error {
+	if err := handler.attachments.removeWhere(ctx, bson.M{"ledger": ledgerID}); err != nil {
+		return err
+	}
+
+	for _, collection := range []*mongo.Collection{handler.transactions, handler.categories, handler.invitations} {
+		if _, err := collection.DeleteMany(ctx, bson.M{"ledger": ledgerID}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
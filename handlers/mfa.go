@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/metrics"
+	"expense-tracker-api/models"
+	"expense-tracker-api/ratelimit"
+	"expense-tracker-api/tokens"
+	"expense-tracker-api/totp"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+	// totpSkew accepts codes one step either side to absorb clock drift.
+	totpSkew = 1
+)
+
+// MFAHandler enrols and removes the TOTP second factor of the signed-in
+// user. The second sign-in step lives on AuthHandler.
+type MFAHandler struct {
+	collection *mongo.Collection
+	issuer     string
+	auditLog   *audit.Log
+	timeouts   Timeouts
+}
+
+type MFAEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// RecoveryCodes are shown once, when 2FA is enabled.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// MFAChallenge is returned by SignInHandler instead of a JWT when the user
+// has 2FA enabled. The challenge is exchanged at MFASignInHandler.
+type MFAChallenge struct {
+	MFARequired bool      `json:"mfaRequired"`
+	Challenge   string    `json:"challenge"`
+	Expires     time.Time `json:"expires"`
+}
+
+func NewMFAHandler(timeouts Timeouts, collection *mongo.Collection, issuer string, auditLog *audit.Log) *MFAHandler {
+	return &MFAHandler{
+		collection: collection,
+		issuer:     issuer,
+		auditLog:   auditLog,
+		timeouts:   timeouts,
+	}
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns the codes to show the user and the hashes to
+// store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(raw)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	return codes, hashes, nil
+}
+
+// verifySecondFactor accepts a TOTP code newer than the last one used or
+// an unused recovery code, which is then spent. Both checks are atomic
+// updates so a code can not be replayed concurrently.
+func verifySecondFactor(ctx context.Context, users *mongo.Collection, user models.User, code string) (bool, error) {
+	filter := bson.M{"_id": user.ID, "mfa.enabled": true}
+	var update bson.M
+
+	if step, ok := totp.Validate(user.MFA.Secret, code, time.Now(), totpSkew); ok {
+		filter["mfa.lastStep"] = bson.M{"$lt": step}
+		update = bson.M{"$set": bson.M{"mfa.lastStep": step}}
+	} else {
+		hash := hashRecoveryCode(code)
+		filter["mfa.recoveryCodes"] = hash
+		update = bson.M{"$pull": bson.M{"mfa.recoveryCodes": hash}}
+	}
+
+	result, err := users.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+func (handler *MFAHandler) Enroll(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	user, ok := currentUser(ctx, c, handler.collection)
+	if !ok {
+		return
+	}
+
+	if user.MFA.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = handler.collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"mfa.pendingSecret": secret}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, MFAEnrolment{
+		Secret: secret,
+		URI:    totp.URI(handler.issuer, user.Email, secret),
+	})
+}
+
+// Verify finishes enrolment with a code from the authenticator app and
+// enables 2FA.
+func (handler *MFAHandler) Verify(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.MFACode
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentUser(ctx, c, handler.collection)
+	if !ok {
+		return
+	}
+
+	if user.MFA.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	if user.MFA.PendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start enrolment first"})
+		return
+	}
+
+	step, valid := totp.Validate(user.MFA.PendingSecret, request.Code, time.Now(), totpSkew)
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = updateUser(ctx, c, handler.auditLog, handler.collection, bson.M{
+		"_id":               user.ID,
+		"mfa.pendingSecret": user.MFA.PendingSecret,
+	}, bson.M{"$set": bson.M{"mfa": models.MFA{
+		Enabled:       true,
+		Secret:        user.MFA.PendingSecret,
+		RecoveryCodes: hashes,
+		LastStep:      step,
+	}}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusConflict, gin.H{"error": "Enrolment was restarted, scan the new code"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+}
+
+// Disable turns 2FA off after checking the password, if the account has
+// one, and a second factor.
+func (handler *MFAHandler) Disable(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.MFADisable
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentUser(ctx, c, handler.collection)
+	if !ok {
+		return
+	}
+
+	if !user.MFA.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	// Users created through OIDC have no password; the second factor
+	// re-authenticates them alone.
+	if user.Password != "" {
+		if valid, _ := checkPassword(user.Password, request.Password); !valid {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Password is incorrect"})
+			return
+		}
+	}
+
+	valid, err := verifySecondFactor(ctx, handler.collection, user, request.Code)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !valid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	err = updateUser(ctx, c, handler.auditLog, handler.collection, bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"mfa": ""}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// challenge starts the second sign-in step for a user with 2FA enabled.
+func (handler *AuthHandler) challenge(ctx context.Context, user models.User) (MFAChallenge, error) {
+	token, payload, err := handler.accounts.signer.Issue(tokens.MFAChallenge, user.ID.Hex(), user.Email, mfaChallengeTTL)
+	if err != nil {
+		return MFAChallenge{}, err
+	}
+
+	if err := handler.accounts.tokens.Save(ctx, payload); err != nil {
+		return MFAChallenge{}, err
+	}
+
+	return MFAChallenge{MFARequired: true, Challenge: token, Expires: payload.ExpiresAt}, nil
+}
+
+// MFASignInHandler exchanges a sign-in challenge and a TOTP or recovery
+// code for a JWT. Wrong codes count towards the sign-in lockout.
+func (handler *AuthHandler) MFASignInHandler(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.MFASignIn
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := handler.accounts.signer.Parse(request.Challenge, tokens.MFAChallenge)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	lockoutKey := strings.ToLower(payload.Email)
+	if locked, err := handler.lockout.Locked(ctx, lockoutKey); err == nil && locked > 0 {
+		ratelimit.TooManyRequests(c, locked)
+		return
+	}
+
+	var user models.User
+	userID, _ := primitive.ObjectIDFromHex(payload.UserID)
+	err = handler.collection.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid challenge"})
+		return
+	}
+
+	valid, err := verifySecondFactor(ctx, handler.collection, user, request.Code)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !valid {
+		metrics.SignInFailures.Inc()
+		if lock, _ := handler.lockout.Fail(ctx, lockoutKey); lock > 0 {
+			logging.FromContext(ctx).Warn("sign-in locked after repeated failures", "locked_for", lock.String())
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return
+	}
+
+	err = handler.accounts.tokens.Consume(ctx, payload)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	handler.lockout.Reset(ctx, lockoutKey)
+
+	JWTOutput, err := handler.sessions.issue(user)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	metrics.SignIns.Inc()
+
+	c.JSON(http.StatusOK, JWTOutput)
+}
@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/migrations"
+	"expense-tracker-api/models"
+	"expense-tracker-api/sso"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	oidcFlowTTL = 10 * time.Minute
+	oidcCodeTTL = time.Minute
+	// oidcStateCookie ties a flow to the browser that started it.
+	oidcStateCookie = "oidc_state"
+)
+
+// OIDCHandler signs users in through external OpenID Connect providers.
+// Users are matched by the provider's subject, then by verified email,
+// and created when neither finds one.
+//
+// The callback is a browser navigation, so instead of answering with a
+// JWT it redirects to the frontend's completeURL with a short-lived code,
+// or an error. The frontend exchanges the code for the sign-in result.
+type OIDCHandler struct {
+	collection  *mongo.Collection
+	flows       *mongo.Collection
+	codes       *mongo.Collection
+	providers   map[string]*sso.Provider
+	auth        *AuthHandler
+	completeURL string
+	timeouts    Timeouts
+}
+
+type oidcFlow struct {
+	State     string    `bson:"_id"`
+	Provider  string    `bson:"provider"`
+	Nonce     string    `bson:"nonce"`
+	Verifier  string    `bson:"verifier"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// oidcCode is a completed sign-in waiting to be exchanged. Only the hash
+// of the code is stored.
+type oidcCode struct {
+	Hash      string             `bson:"_id"`
+	User      primitive.ObjectID `bson:"user"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+func NewOIDCHandler(timeouts Timeouts, collection *mongo.Collection, flows *mongo.Collection, codes *mongo.Collection, providers []*sso.Provider, auth *AuthHandler, completeURL string) *OIDCHandler {
+	byName := map[string]*sso.Provider{}
+	for _, provider := range providers {
+		byName[provider.Name] = provider
+	}
+
+	return &OIDCHandler{
+		collection:  collection,
+		flows:       flows,
+		codes:       codes,
+		providers:   byName,
+		auth:        auth,
+		completeURL: completeURL,
+		timeouts:    timeouts,
+	}
+}
+
+func (handler *OIDCHandler) provider(c *gin.Context) (*sso.Provider, bool) {
+	provider, ok := handler.providers[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown identity provider"})
+	}
+	return provider, ok
+}
+
+func hashOIDCCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// setStateCookie scopes the cookie to the provider's routes, which the
+// login and callback share. An empty state clears it.
+func setStateCookie(c *gin.Context, provider *sso.Provider, state string) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     path.Dir(c.Request.URL.Path) + "/",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		Secure:   strings.HasPrefix(provider.RedirectURL(), "https://"),
+		HttpOnly: true,
+		// Lax still sends the cookie on the provider's redirect back.
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+// complete redirects to the frontend with params added to its URL.
+func (handler *OIDCHandler) complete(c *gin.Context, params url.Values) {
+	target, err := url.Parse(handler.completeURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusFound, target.String())
+}
+
+func (handler *OIDCHandler) fail(c *gin.Context, message string) {
+	handler.complete(c, url.Values{"error": {message}})
+}
+
+// Login redirects to the provider after remembering the flow's state,
+// nonce and PKCE verifier, and setting the state in a cookie.
+func (handler *OIDCHandler) Login(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	provider, ok := handler.provider(c)
+	if !ok {
+		return
+	}
+
+	flow, redirect, err := provider.Start()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = handler.flows.InsertOne(ctx, oidcFlow{
+		State:     flow.State,
+		Provider:  provider.Name,
+		Nonce:     flow.Nonce,
+		Verifier:  flow.Verifier,
+		ExpiresAt: time.Now().Add(oidcFlowTTL),
+	})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	setStateCookie(c, provider, flow.State)
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// Callback completes the flow started by Login in the same browser and
+// redirects to the frontend with a code to exchange for the sign-in.
+func (handler *OIDCHandler) Callback(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	provider, ok := handler.provider(c)
+	if !ok {
+		return
+	}
+
+	cookie, _ := c.Cookie(oidcStateCookie)
+	setStateCookie(c, provider, "")
+
+	if reason := c.Query("error"); reason != "" {
+		handler.fail(c, "Provider refused sign-in: "+reason)
+		return
+	}
+
+	// Without the cookie anyone could have the victim's browser complete
+	// a flow they started, signing the victim into their account.
+	state := c.Query("state")
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		handler.fail(c, "Sign-in was not started in this browser, start again")
+		return
+	}
+
+	// Deleting the flow makes every state usable once.
+	var flow oidcFlow
+	err := handler.flows.FindOneAndDelete(ctx, bson.M{
+		"_id":       state,
+		"provider":  provider.Name,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&flow)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		handler.fail(c, "Sign-in expired or was already completed, start again")
+		return
+	}
+
+	identity, err := provider.Finish(ctx, sso.Flow{State: flow.State, Nonce: flow.Nonce, Verifier: flow.Verifier}, c.Query("code"))
+	if err != nil {
+		logging.FromContext(ctx).Warn("OIDC sign-in failed", "provider", provider.Name, "error", err)
+		handler.fail(c, "Could not verify the identity provider's response")
+		return
+	}
+
+	user, err := handler.findOrCreate(ctx, c, identity)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == errUnverifiedEmail {
+		handler.fail(c, "The identity provider has not verified this email address")
+		return
+	}
+
+	if err != nil {
+		logging.FromContext(ctx).Error("OIDC sign-in failed", "provider", provider.Name, "error", err)
+		handler.fail(c, "Sign-in failed, try again")
+		return
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(secret)
+
+	_, err = handler.codes.InsertOne(ctx, oidcCode{
+		Hash:      hashOIDCCode(code),
+		User:      user.ID,
+		ExpiresAt: time.Now().Add(oidcCodeTTL),
+	})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	handler.complete(c, url.Values{"code": {code}})
+}
+
+// Exchange trades a code from the callback's redirect for a JWT, or an
+// MFA challenge, like SignInHandler. Each code works once.
+func (handler *OIDCHandler) Exchange(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.OIDCExchange
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var code oidcCode
+	err := handler.codes.FindOneAndDelete(ctx, bson.M{
+		"_id":       hashOIDCCode(request.Code),
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&code)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code expired or was already used, sign in again"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	err = handler.collection.FindOne(ctx, bson.M{"_id": code.User}).Decode(&user)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Account no longer exists"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	handler.auth.completeSignIn(ctx, c, user)
+}
+
+var (
+	errUnverifiedEmail = errors.New("identity provider has not verified the email address")
+	errNoFreeUsername  = errors.New("could not find a free username")
+)
+
+func (handler *OIDCHandler) findOrCreate(ctx context.Context, c *gin.Context, identity sso.Identity) (models.User, error) {
+	var user models.User
+
+	key := identity.Provider + ":" + identity.Subject
+
+	err := handler.collection.FindOne(ctx, bson.M{"identities.key": key}).Decode(&user)
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	// Linking by email is only safe when the provider vouches for it.
+	if identity.Email == "" || !identity.EmailVerified {
+		return user, errUnverifiedEmail
+	}
+
+	link := models.Identity{Key: key, Provider: identity.Provider, Subject: identity.Subject, LinkedAt: time.Now()}
+
+	err = handler.collection.FindOne(ctx, bson.M{"email": identity.Email}).Decode(&user)
+	if err == nil {
+		err = updateUser(ctx, c, handler.auth.accounts.auditLog, handler.collection, bson.M{"_id": user.ID}, bson.M{
+			"$push": bson.M{"identities": link},
+			"$set":  bson.M{"emailVerified": true},
+		})
+		user.EmailVerified = true
+		return user, err
+	}
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	return handler.create(ctx, c, identity, link)
+}
+
+var usernameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// create registers a user for a new identity. The empty password never
+// matches a hash, so the user signs in through the provider until they
+// set a password with a password reset.
+func (handler *OIDCHandler) create(ctx context.Context, c *gin.Context, identity sso.Identity, link models.Identity) (models.User, error) {
+	base := usernameChars.ReplaceAllString(identity.Username, "")
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	user := models.User{
+		ID:            primitive.NewObjectID(),
+		Username:      base,
+		Email:         identity.Email,
+		EmailVerified: true,
+		Identities:    []models.Identity{link},
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		created := bson.M{
+			"_id":           user.ID,
+			"username":      user.Username,
+			"email":         user.Email,
+			"password":      "",
+			"emailVerified": true,
+			"identities":    user.Identities,
+		}
+		_, err := handler.collection.InsertOne(ctx, created)
+		if err == nil {
+			recordCreate(ctx, c, handler.auth.accounts.auditLog, audit.User, user.ID, created)
+			handler.auth.createPersonalLedger(ctx, user.ID)
+		}
+		if !duplicateKey(err, migrations.UsersUsernameIndex) {
+			return user, err
+		}
+
+		suffix := make([]byte, 2)
+		rand.Read(suffix)
+		user.Username = base + "-" + hex.EncodeToString(suffix)
+	}
+
+	return user, errNoFreeUsername
+}
@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/sso"
+	"expense-tracker-api/sso/ssotest"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const completeURL = "https://app.example.com/oidc/complete"
+
+var alice = ssotest.User{Subject: "alice-id", Email: "alice@example.com", EmailVerified: true, Username: "alice"}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// oidcTest runs the OIDC routes against a mock provider, with Mongo
+// replaced by mt's scripted responses.
+type oidcTest struct {
+	mt       *mtest.T
+	idp      *ssotest.IdP
+	provider *sso.Provider
+	router   *gin.Engine
+}
+
+func newOIDCTest(mt *mtest.T) *oidcTest {
+	idp, err := ssotest.NewIdP()
+	if err != nil {
+		mt.Fatal(err)
+	}
+	mt.Cleanup(idp.Close)
+
+	provider, err := sso.NewProvider(context.Background(), sso.Settings{
+		Name:         "mock",
+		Issuer:       idp.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://api.example.com/api/v1/auth/oidc/mock/callback",
+	})
+	if err != nil {
+		mt.Fatal(err)
+	}
+
+	timeouts := Timeouts{Read: 5 * time.Second, Write: 5 * time.Second}
+	users := mt.DB.Collection("users")
+	accounts := NewAccountHandler(timeouts, users, nil, nil, nil, "", audit.NewLog(mt.DB, "audit_log"))
+	auth := NewAuthHandler(timeouts, users, mt.DB.Collection("ledgers"), nil, nil, accounts, false)
+	handler := NewOIDCHandler(timeouts, users, mt.DB.Collection("oidc_flows"), mt.DB.Collection("oidc_codes"),
+		[]*sso.Provider{provider}, auth, completeURL)
+
+	router := gin.New()
+	router.GET("/api/v1/auth/oidc/:provider/login", handler.Login)
+	router.GET("/api/v1/auth/oidc/:provider/callback", handler.Callback)
+	router.POST("/api/v1/auth/oidc/exchange", handler.Exchange)
+
+	return &oidcTest{mt: mt, idp: idp, provider: provider, router: router}
+}
+
+func (test *oidcTest) serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	test.router.ServeHTTP(w, req)
+	return w
+}
+
+// approve starts a flow the way Login does and has user approve it at the
+// provider. It returns the flow as Login stores it and the callback URL.
+func (test *oidcTest) approve(user ssotest.User) (bson.D, *url.URL) {
+	flow, authURL, err := test.provider.Start()
+	if err != nil {
+		test.mt.Fatal(err)
+	}
+
+	callback, err := test.idp.Authorize(authURL, user)
+	if err != nil {
+		test.mt.Fatal(err)
+	}
+
+	return bson.D{
+		{"_id", flow.State},
+		{"provider", "mock"},
+		{"nonce", flow.Nonce},
+		{"verifier", flow.Verifier},
+		{"expiresAt", time.Now().Add(oidcFlowTTL)},
+	}, callback
+}
+
+// callback calls the callback route with the state cookie set to cookie.
+func (test *oidcTest) callback(callback *url.URL, cookie string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: cookie})
+	}
+	return test.serve(req)
+}
+
+// completed checks the redirect to the frontend and returns its query.
+func completed(mt *mtest.T, w *httptest.ResponseRecorder) url.Values {
+	mt.Helper()
+
+	if w.Code != http.StatusFound {
+		mt.Fatalf("status = %d, want %d: %s", w.Code, http.StatusFound, w.Body)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		mt.Fatal(err)
+	}
+
+	if got := location.Scheme + "://" + location.Host + location.Path; got != completeURL {
+		mt.Fatalf("redirected to %s, want %s", got, completeURL)
+	}
+
+	return location.Query()
+}
+
+func failedWith(mt *mtest.T, w *httptest.ResponseRecorder, want string) {
+	mt.Helper()
+
+	query := completed(mt, w)
+	if query.Get("code") != "" {
+		mt.Fatalf("redirect carries a code: %v", query)
+	}
+	if !strings.Contains(query.Get("error"), want) {
+		mt.Fatalf("error = %q, want it to contain %q", query.Get("error"), want)
+	}
+}
+
+func userDoc(id primitive.ObjectID, identities ...bson.D) bson.D {
+	doc := bson.D{
+		{"_id", id},
+		{"username", "alice"},
+		{"email", "alice@example.com"},
+		{"password", ""},
+		{"emailVerified", true},
+	}
+	if len(identities) > 0 {
+		doc = append(doc, bson.E{"identities", identities})
+	}
+	return doc
+}
+
+func found(ns string, docs ...bson.D) bson.D {
+	return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, docs...)
+}
+
+func modified(value interface{}) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{"value", value})
+}
+
+// command returns the first command named name that was sent to Mongo.
+func command(mt *mtest.T, name string, collection string) bson.Raw {
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == name && event.Command.Lookup(name).StringValue() == collection {
+			return event.Command
+		}
+	}
+	mt.Fatalf("no %s command on %s", name, collection)
+	return nil
+}
+
+func TestOIDCLogin(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("sets the state cookie", func(mt *mtest.T) {
+		test := newOIDCTest(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		w := test.serve(httptest.NewRequest(http.MethodGet, "/api/v1/auth/oidc/mock/login", nil))
+
+		if w.Code != http.StatusFound {
+			mt.Fatalf("status = %d, want %d: %s", w.Code, http.StatusFound, w.Body)
+		}
+
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if !strings.HasPrefix(location.String(), test.idp.URL+"/authorize") {
+			mt.Fatalf("redirected to %s", location)
+		}
+
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			mt.Fatalf("cookies = %v", cookies)
+		}
+
+		cookie := cookies[0]
+		if cookie.Name != oidcStateCookie || cookie.Value != location.Query().Get("state") {
+			mt.Errorf("cookie %s=%s does not carry the state %s", cookie.Name, cookie.Value, location.Query().Get("state"))
+		}
+		if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+			mt.Errorf("cookie HttpOnly=%v Secure=%v SameSite=%v", cookie.HttpOnly, cookie.Secure, cookie.SameSite)
+		}
+		if cookie.Path != "/api/v1/auth/oidc/mock/" {
+			mt.Errorf("cookie path = %s", cookie.Path)
+		}
+
+		insert := command(mt, "insert", "oidc_flows")
+		stored := insert.Lookup("documents", "0", "_id").StringValue()
+		if stored != cookie.Value {
+			mt.Errorf("stored state %s, cookie %s", stored, cookie.Value)
+		}
+	})
+}
+
+func TestOIDCCallback(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("signs in a linked user", func(mt *mtest.T) {
+		test := newOIDCTest(mt)
+		flow, callback := test.approve(alice)
+		userID := primitive.NewObjectID()
+
+		mt.AddMockResponses(
+			modified(flow),
+			found("db.users", userDoc(userID, bson.D{{"key", "mock:alice-id"}, {"provider", "mock"}, {"subject", "alice-id"}})),
+			mtest.CreateSuccessResponse(),
+		)
+
+		w := test.callback(callback, callback.Query().Get("state"))
+
+		query := completed(mt, w)
+		code := query.Get("code")
+		if code == "" || query.Get("error") != "" {
+			mt.Fatalf("redirect query = %v, want a code", query)
+		}
+
+		insert := command(mt, "insert", "oidc_codes")
+		if hash := insert.Lookup("documents", "0", "_id").StringValue(); hash != hashOIDCCode(code) {
+			mt.Errorf("stored code hash %s, want %s", hash, hashOIDCCode(code))
+		}
+		if user := insert.Lookup("documents", "0", "user").ObjectID(); user != userID {
+			mt.Errorf("code is for user %s, want %s", user.Hex(), userID.Hex())
+		}
+
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == oidcStateCookie && cookie.MaxAge >= 0 {
+				mt.Errorf("state cookie not cleared: %v", cookie)
+			}
+		}
+	})
+
+	mt.Run("links an existing account by verified email", func(mt *mtest.T) {
+		test := newOIDCTest(mt)
+		flow, callback := test.approve(alice)
+		userID := primitive.NewObjectID()
+		identity := bson.D{{"key", "mock:alice-id"}, {"provider", "mock"}, {"subject", "alice-id"}}
+
+		mt.AddMockResponses(
+			modified(flow),
+			found("db.users"),
+			found("db.users", userDoc(userID)),
+			modified(userDoc(userID)),
+			found("db.users", userDoc(userID, identity)),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+
+		w := test.callback(callback, callback.Query().Get("state"))
+
+		if query := completed(mt, w); query.Get("code") == "" {
+			mt.Fatalf("redirect query = %v, want a code", query)
+		}
+
+		update := command(mt, "findAndModify", "users")
+		if id := update.Lookup("query", "_id").ObjectID(); id != userID {
+			mt.Errorf("updated user %s, want %s", id.Hex(), userID.Hex())
+		}
+		if key := update.Lookup("update", "$push", "identities", "key").StringValue(); key != "mock:alice-id" {
+			mt.Errorf("linked identity %q, want mock:alice-id", key)
+		}
+
+		entry := command(mt, "insert", "audit_log")
+		if action := entry.Lookup("documents", "0", "action").StringValue(); action != audit.Update {
+			mt.Errorf("audit action %q, want %q", action, audit.Update)
+		}
+	})
+
+	mt.Run("rejects an unverified email", func(mt *mtest.T) {
+		test := newOIDCTest(mt)
+		user := alice
+		user.EmailVerified = false
+		flow, callback := test.approve(user)
+
+		mt.AddMockResponses(
+			modified(flow),
+			found("db.users"),
+		)
+
+		w := test.callback(callback, callback.Query().Get("state"))
+
+		failedWith(mt, w, "has not verified")
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" {
+				mt.Errorf("unexpected insert into %s", event.Command.Lookup("insert").StringValue())
+			}
+		}
+	})
+
+	mt.Run("rejects a state from another browser", func(mt *mtest.T) {
+		test := newOIDCTest(mt)
+		_, callback := test.approve(alice)
+
+		for _, cookie := range []string{"", "someone-elses-state"} {
+			w := test.callback(callback, cookie)
+			failedWith(mt, w, "not started in this browser")
+		}
+
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			mt.Errorf("flow was looked up, %d commands sent", len(events))
+		}
+	})
+
+	mt.Run("rejects a replayed state", func(mt *mtest.T) {
+		test := newOIDCTest(mt)
+		_, callback := test.approve(alice)
+
+		// The first callback deleted the flow, so it is no longer found.
+		mt.AddMockResponses(modified(nil))
+
+		w := test.callback(callback, callback.Query().Get("state"))
+
+		failedWith(mt, w, "already completed")
+		remove := command(mt, "findAndModify", "oidc_flows")
+		if !remove.Lookup("remove").Boolean() {
+			mt.Error("flow was not deleted on use")
+		}
+	})
+
+	mt.Run("passes on a provider error", func(mt *mtest.T) {
+		test := newOIDCTest(mt)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/oidc/mock/callback?error=access_denied", nil)
+		failedWith(mt, test.serve(req), "access_denied")
+	})
+}
+
+func TestOIDCExchange(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("rejects a used code", func(mt *mtest.T) {
+		test := newOIDCTest(mt)
+		mt.AddMockResponses(modified(nil))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/oidc/exchange", strings.NewReader(`{"code":"used"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := test.serve(req)
+
+		if w.Code != http.StatusBadRequest {
+			mt.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+		}
+
+		remove := command(mt, "findAndModify", "oidc_codes")
+		if hash := remove.Lookup("query", "_id").StringValue(); hash != hashOIDCCode("used") {
+			mt.Errorf("looked up %s, want the hash of the code", hash)
+		}
+	})
+}
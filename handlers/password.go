@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordCost = bcrypt.DefaultCost
+
+// dummyPasswordHash is checked against when there is no account, so that
+// an unknown email takes as long to reject as a wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("no account"), passwordCost)
+
+// hashPassword hashes a password for storage. bcrypt refuses passwords
+// over 72 bytes, which the request bindings only catch for ASCII ones.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(hash), err
+}
+
+// hashFailed writes the response for an error from hashPassword.
+func hashFailed(c *gin.Context, err error) {
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password should be at most 72 bytes"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// checkPassword reports whether password matches the stored hash, and
+// whether the hash should be replaced with a fresh one. Accounts from
+// before bcrypt hold the password followed by the SHA-256 of nothing; they
+// are upgraded on their next successful sign-in.
+func checkPassword(stored string, password string) (ok bool, rehash bool) {
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		legacy := sha256.New().Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(stored), legacy) == 1, true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+	return true, cost < passwordCost
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// patchField converts a JSON Merge Patch value into the document fields
+// to $set. A null value removes the fields of an optional patchField and
+// is rejected for any other.
+type patchField struct {
+	names    []string
+	set      func(value interface{}) (bson.D, error)
+	nullable bool
+}
+
+func (field patchField) optional() patchField {
+	field.nullable = true
+	return field
+}
+
+var errPatchEmpty = errors.New("patch does not change any field")
+
+// buildPatch applies RFC 7396 semantics to a flat document and returns the
+// update: present members are validated and $set, null members are $unset.
+func buildPatch(body map[string]interface{}, fields map[string]patchField) (bson.D, error) {
+	set := bson.D{}
+	unset := bson.D{}
+
+	for key, value := range body {
+		field, ok := fields[key]
+		if !ok {
+			return nil, fmt.Errorf("field %q can not be patched", key)
+		}
+
+		if value == nil {
+			if !field.nullable {
+				return nil, fmt.Errorf("field %q is required and can not be removed", key)
+			}
+			for _, name := range field.names {
+				unset = append(unset, bson.E{name, ""})
+			}
+			continue
+		}
+
+		fieldSet, err := field.set(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", key, err)
+		}
+		set = append(set, fieldSet...)
+	}
+
+	update := bson.D{}
+	if len(set) > 0 {
+		update = append(update, bson.E{"$set", set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{"$unset", unset})
+	}
+
+	if len(update) == 0 {
+		return nil, errPatchEmpty
+	}
+
+	return update, nil
+}
+
+// stringField patches a string of at least min and at most max
+// characters, or of any length above min when max is 0, like the required
+// and max binding tags on the model.
+func stringField(name string, min int, max int) patchField {
+	return patchField{names: []string{name}, set: func(value interface{}) (bson.D, error) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("should be a string")
+		}
+		if utf8.RuneCountInString(s) < min {
+			if min == 1 {
+				return nil, errors.New("should not be empty")
+			}
+			return nil, fmt.Errorf("should be at least %d characters long", min)
+		}
+		if max > 0 && utf8.RuneCountInString(s) > max {
+			return nil, fmt.Errorf("should be at most %d characters long", max)
+		}
+		return bson.D{{name, s}}, nil
+	}}
+}
+
+// stringListField patches a list of at most maxItems strings, each at most
+// maxLength characters long, like a "max=maxItems,dive,max=maxLength" tag.
+func stringListField(name string, maxItems int, maxLength int) patchField {
+	return patchField{names: []string{name}, set: func(value interface{}) (bson.D, error) {
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, errors.New("should be a list of strings")
+		}
+		if len(items) > maxItems {
+			return nil, fmt.Errorf("should have at most %d items", maxItems)
+		}
+		list := make([]string, len(items))
+		for i, item := range items {
+			if list[i], ok = item.(string); !ok {
+				return nil, errors.New("should be a list of strings")
+			}
+			if utf8.RuneCountInString(list[i]) > maxLength {
+				return nil, fmt.Errorf("items should be at most %d characters long", maxLength)
+			}
+		}
+		return bson.D{{name, list}}, nil
+	}}
+}
+
+func intField(name string) patchField {
+	return patchField{names: []string{name}, set: func(value interface{}) (bson.D, error) {
+		f, ok := value.(float64)
+		if !ok || f != float64(int(f)) {
+			return nil, errors.New("should be an integer")
+		}
+		return bson.D{{name, int(f)}}, nil
+	}}
+}
+
+// nonNegativeIntField patches an integer that may not be below zero, like
+// the gte=0 binding tag on the model.
+func nonNegativeIntField(name string) patchField {
+	field := intField(name)
+	set := field.set
+	field.set = func(value interface{}) (bson.D, error) {
+		if f, ok := value.(float64); ok && f < 0 {
+			return nil, errors.New("should not be negative")
+		}
+		return set(value)
+	}
+	return field
+}
+
+func objectIDField(name string) patchField {
+	return patchField{names: []string{name}, set: func(value interface{}) (bson.D, error) {
+		s, _ := value.(string)
+		id, err := primitive.ObjectIDFromHex(s)
+		if err != nil {
+			return nil, errors.New("should be an object id")
+		}
+		return bson.D{{name, id}}, nil
+	}}
+}
+
+// dateField patches the "date" string together with the "invdt" DateTime
+// that is derived from it.
+func dateField() patchField {
+	return patchField{names: []string{"date", "invdt"}, set: func(value interface{}) (bson.D, error) {
+		s, _ := value.(string)
+		dt, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, errors.New("should be a date in YYYY-MM-DD format")
+		}
+		return bson.D{{"date", s}, {"invdt", primitive.NewDateTimeFromTime(dt)}}, nil
+	}}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"expense-tracker-api/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Scopes a caller can be granted. Session tokens carry all of them, API
+// keys the ones chosen at creation, which never include ScopeProfile.
+const (
+	ScopeProfile           = "profile"
+	ScopeReadCategories    = "read:categories"
+	ScopeWriteCategories   = "write:categories"
+	ScopeReadTransactions  = "read:transactions"
+	ScopeWriteTransactions = "write:transactions"
+	ScopeReadReports       = "read:reports"
+)
+
+var allScopes = []string{
+	ScopeProfile,
+	ScopeReadCategories,
+	ScopeWriteCategories,
+	ScopeReadTransactions,
+	ScopeWriteTransactions,
+	ScopeReadReports,
+}
+
+// Principal is the authenticated caller. AuthMiddleware resolves it once
+// per request; handlers read it with principalOf.
+type Principal struct {
+	UserID primitive.ObjectID
+	Email  string
+	Roles  []string
+	Scopes []string
+	// APIKeyID is set when the caller authenticated with an API key.
+	APIKeyID primitive.ObjectID
+}
+
+const principalKey = "principal"
+
+func principalOf(c *gin.Context) Principal {
+	return c.MustGet(principalKey).(Principal)
+}
+
+func (principal Principal) HasRole(role string) bool {
+	return contains(principal.Roles, role)
+}
+
+func (principal Principal) HasScope(scope string) bool {
+	return contains(principal.Scopes, scope)
+}
+
+// RequireScope rejects callers whose token was not granted scope. It runs
+// after AuthMiddleware.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !principalOf(c).HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token lacks the " + scope + " scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+type cachedPrincipal struct {
+	principal Principal
+	expires   time.Time
+}
+
+// principalCache remembers resolved users for a short while so that
+// authenticated requests do not all hit the users collection. Handlers
+// that change or delete a user call forget.
+type principalCache struct {
+	users   *mongo.Collection
+	ttl     time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[primitive.ObjectID]cachedPrincipal
+}
+
+func newPrincipalCache(users *mongo.Collection, ttl time.Duration, maxSize int) *principalCache {
+	return &principalCache{
+		users:   users,
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: map[primitive.ObjectID]cachedPrincipal{},
+	}
+}
+
+// resolve returns the principal for a user ID, or mongo.ErrNoDocuments
+// when the user no longer exists.
+func (cache *principalCache) resolve(ctx context.Context, userID primitive.ObjectID) (Principal, error) {
+	now := time.Now()
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[userID]
+	cache.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		return entry.principal, nil
+	}
+
+	var user models.User
+	err := cache.users.FindOne(ctx, bson.M{"_id": userID},
+		options.FindOne().SetProjection(bson.M{"email": 1, "roles": 1})).Decode(&user)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	principal := Principal{UserID: user.ID, Email: user.Email, Roles: user.Roles}
+	if len(principal.Roles) == 0 {
+		principal.Roles = []string{RoleUser}
+	}
+
+	cache.mu.Lock()
+	if len(cache.entries) >= cache.maxSize {
+		// Dropping everything is crude but keeps memory bounded; the
+		// entries are cheap to load again.
+		cache.entries = map[primitive.ObjectID]cachedPrincipal{}
+	}
+	cache.entries[userID] = cachedPrincipal{principal: principal, expires: now.Add(cache.ttl)}
+	cache.mu.Unlock()
+
+	return principal, nil
+}
+
+func (cache *principalCache) forget(userID primitive.ObjectID) {
+	cache.mu.Lock()
+	delete(cache.entries, userID)
+	cache.mu.Unlock()
+}
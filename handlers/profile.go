@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/migrations"
+	"expense-tracker-api/models"
+	"expense-tracker-api/tokens"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ProfileHandler struct {
+	collection *mongo.Collection
+	sessions   *Sessions
+	accounts   *AccountHandler
+	ledgers    *LedgerHandler
+	timeouts   Timeouts
+}
+
+func NewProfileHandler(timeouts Timeouts, collection *mongo.Collection, sessions *Sessions, accounts *AccountHandler, ledgers *LedgerHandler) *ProfileHandler {
+	return &ProfileHandler{
+		collection: collection,
+		sessions:   sessions,
+		accounts:   accounts,
+		ledgers:    ledgers,
+		timeouts:   timeouts,
+	}
+}
+
+func profileOf(user models.User) models.Profile {
+	return models.Profile{
+		ID:            user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		MFAEnabled:    user.MFA.Enabled,
+	}
+}
+
+func (handler *ProfileHandler) GetProfile(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	user, ok := currentUser(ctx, c, handler.collection)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, profileOf(user))
+}
+
+// UpdateProfile changes the username and/or email. A new email address
+// has to be verified again.
+func (handler *ProfileHandler) UpdateProfile(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.ProfileUpdate
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentUser(ctx, c, handler.collection)
+	if !ok {
+		return
+	}
+
+	set := bson.M{}
+	if username := strings.TrimSpace(request.Username); username != "" && username != user.Username {
+		set["username"] = username
+		user.Username = username
+	}
+
+	emailChanged := request.Email != "" && request.Email != user.Email
+	if emailChanged {
+		set["email"] = request.Email
+		set["emailVerified"] = false
+		user.Email = request.Email
+		user.EmailVerified = false
+	}
+
+	if len(set) == 0 {
+		c.JSON(http.StatusOK, profileOf(user))
+		return
+	}
+
+	err := updateUser(ctx, c, handler.accounts.auditLog, handler.collection, bson.M{"_id": user.ID}, bson.M{"$set": set})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if duplicateKey(err, migrations.UsersUsernameIndex) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username alredy exists"})
+		return
+	}
+
+	if duplicateKey(err, migrations.UsersEmailIndex) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email alredy exists"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	handler.sessions.principals.forget(user.ID)
+
+	if emailChanged {
+		// Links mailed to the old address must stop working.
+		for _, purpose := range []tokens.Purpose{tokens.VerifyEmail, tokens.ResetPassword} {
+			if err := handler.accounts.tokens.Revoke(ctx, user.ID.Hex(), purpose); err != nil {
+				logging.FromContext(ctx).Warn("revoking tokens failed", "error", err)
+			}
+		}
+
+		if err := handler.accounts.sendVerification(ctx, user); err != nil {
+			logging.FromContext(ctx).Error("sending verification email failed", "error", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, profileOf(user))
+}
+
+func (handler *ProfileHandler) ChangePassword(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.PasswordChange
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentUser(ctx, c, handler.collection)
+	if !ok {
+		return
+	}
+
+	if valid, _ := checkPassword(user.Password, request.CurrentPassword); !valid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	password, err := hashPassword(request.NewPassword)
+	if err != nil {
+		hashFailed(c, err)
+		return
+	}
+
+	// Matching the hash that was checked keeps a concurrent change from
+	// being overwritten with a password checked against the old one.
+	err = updateUser(ctx, c, handler.accounts.auditLog, handler.collection, bson.M{
+		"_id":      user.ID,
+		"password": user.Password,
+	}, bson.M{"$set": bson.M{"password": password}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusConflict, gin.H{"error": "The password was changed meanwhile, try again"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := handler.accounts.tokens.Revoke(ctx, user.ID.Hex(), tokens.ResetPassword); err != nil {
+		logging.FromContext(ctx).Warn("revoking reset tokens failed", "error", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password was successfully changed"})
+}
+
+// DeleteAccount removes the user together with their API keys and the
+// ledgers only they use. Shared ledgers keep their data. The user goes last
+// so a failed request can be retried.
+//
+// A session token alone is not enough: the caller confirms with the
+// password and, with 2FA enabled, a code. Accounts that only sign in
+// through an identity provider have no password to confirm with.
+func (handler *ProfileHandler) DeleteAccount(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var request models.AccountDeletion
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentUser(ctx, c, handler.collection)
+	if !ok {
+		return
+	}
+
+	if user.Password != "" {
+		if valid, _ := checkPassword(user.Password, request.Password); !valid {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Password is incorrect"})
+			return
+		}
+	}
+
+	if user.MFA.Enabled {
+		valid, err := verifySecondFactor(ctx, handler.collection, user, request.Code)
+
+		if dbTimeout(c, err) {
+			return
+		}
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !valid {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid code"})
+			return
+		}
+	}
+
+	err := handler.ledgers.removeMember(ctx, user.ID)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err == errSoleOwner {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = handler.sessions.apiKeys.DeleteMany(ctx, bson.M{"owner": user.ID})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var deleted bson.M
+	err = handler.collection.FindOneAndDelete(ctx, bson.M{"_id": user.ID}).Decode(&deleted)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	record(ctx, c, handler.accounts.auditLog, audit.User, user.ID, audit.Delete, audit.Diff(audit.User, deleted, nil))
+
+	handler.sessions.principals.forget(user.ID)
+
+	for _, purpose := range []tokens.Purpose{tokens.VerifyEmail, tokens.ResetPassword} {
+		if err := handler.accounts.tokens.Revoke(ctx, user.ID.Hex(), purpose); err != nil {
+			logging.FromContext(ctx).Warn("revoking tokens failed", "error", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account successfully removed"})
+}
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"expense-tracker-api/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxSearchResults = 100
+
+// categoryMatchScore ranks a match on the category name alongside text
+// index scores, about level with a single description hit.
+const categoryMatchScore = 1.0
+
+type SearchHandler struct {
+	transactions *mongo.Collection
+	categories   *mongo.Collection
+	timeouts     Timeouts
+}
+
+// Match is a matched span in rune offsets, end exclusive.
+type Match struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type Highlight struct {
+	Field   string  `json:"field"`
+	Text    string  `json:"text"`
+	Matches []Match `json:"matches"`
+}
+
+type SearchResult struct {
+	Transaction models.Transaction `json:"transaction"`
+	Score       float64            `json:"score"`
+	Highlights  []Highlight        `json:"highlights"`
+}
+
+type searchHit struct {
+	models.Transaction `bson:",inline"`
+	Score              float64 `bson:"score"`
+}
+
+func NewSearchHandler(timeouts Timeouts, transactions *mongo.Collection, categories *mongo.Collection) *SearchHandler {
+	return &SearchHandler{
+		transactions: transactions,
+		categories:   categories,
+		timeouts:     timeouts,
+	}
+}
+
+// searchFilter turns the from, to, minAmount and maxAmount query
+// parameters into conditions on the selected ledger's transactions.
+func searchFilter(c *gin.Context) (bson.D, error) {
+	filter := bson.D{{"ledger", ledgerOf(c).ID}, {"deletedAt", nil}}
+
+	dates := bson.D{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		if value := c.Query(param); value != "" {
+			dt, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return nil, errors.New(param + " should be a date in YYYY-MM-DD format")
+			}
+			dates = append(dates, bson.E{op, primitive.NewDateTimeFromTime(dt)})
+		}
+	}
+	if len(dates) > 0 {
+		filter = append(filter, bson.E{"invdt", dates})
+	}
+
+	amounts := bson.D{}
+	for param, op := range map[string]string{"minAmount": "$gte", "maxAmount": "$lte"} {
+		if value := c.Query(param); value != "" {
+			amount, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.New(param + " should be an integer")
+			}
+			amounts = append(amounts, bson.E{op, amount})
+		}
+	}
+	if len(amounts) > 0 {
+		filter = append(filter, bson.E{"amount", amounts})
+	}
+
+	return filter, nil
+}
+
+// Search finds transactions in the selected ledger whose description,
+// payee, notes or tags match q through the text index, or whose category
+// name contains one of its words. Results are ranked by score and carry
+// the matched spans of each field.
+func (handler *SearchHandler) Search(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	q := strings.TrimSpace(c.Query("q"))
+	terms := strings.Fields(strings.ToLower(q))
+	if len(terms) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 20
+	}
+	if limit > maxSearchResults {
+		limit = maxSearchResults
+	}
+
+	filter, err := searchFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	termPattern := strings.Join(quoted, "|")
+
+	var matchedCategories []models.Category
+	cur, err := handler.categories.Find(ctx, bson.M{
+		"ledger":    ledgerOf(c).ID,
+		"deletedAt": nil,
+		"name":      primitive.Regex{Pattern: termPattern, Options: "i"},
+	})
+	if err == nil {
+		err = cur.All(ctx, &matchedCategories)
+	}
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	hits := map[primitive.ObjectID]searchHit{}
+
+	var textHits []searchHit
+	cur, err = handler.transactions.Find(ctx, append(filter, bson.E{"$text", bson.D{{"$search", q}}}),
+		options.Find().
+			SetProjection(bson.D{{"score", bson.D{{"$meta", "textScore"}}}}).
+			SetSort(bson.D{{"score", bson.D{{"$meta", "textScore"}}}}).
+			SetLimit(int64(limit)))
+	if err == nil {
+		err = cur.All(ctx, &textHits)
+	}
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, hit := range textHits {
+		hits[hit.ID] = hit
+	}
+
+	if len(matchedCategories) > 0 {
+		ids := make([]primitive.ObjectID, len(matchedCategories))
+		for i, category := range matchedCategories {
+			ids[i] = category.ID
+		}
+
+		var categoryHits []searchHit
+		cur, err = handler.transactions.Find(ctx, append(filter, bson.E{"category", bson.D{{"$in", ids}}}),
+			options.Find().SetSort(bson.D{{"invdt", -1}}).SetLimit(int64(limit)))
+		if err == nil {
+			err = cur.All(ctx, &categoryHits)
+		}
+
+		if dbTimeout(c, err) {
+			return
+		}
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, hit := range categoryHits {
+			hit.Score += hits[hit.ID].Score + categoryMatchScore
+			hits[hit.ID] = hit
+		}
+	}
+
+	ranked := make([]searchHit, 0, len(hits))
+	for _, hit := range hits {
+		ranked = append(ranked, hit)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].InvDt > ranked[j].InvDt
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	categoryNames, ok := handler.categoryNames(c, ranked)
+	if !ok {
+		return
+	}
+
+	results := make([]SearchResult, len(ranked))
+	for i, hit := range ranked {
+		results[i] = SearchResult{
+			Transaction: hit.Transaction,
+			Score:       hit.Score,
+			Highlights:  highlight(hit.Transaction, categoryNames[hit.Category], terms),
+		}
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// categoryNames loads the names of the categories the hits belong to.
+func (handler *SearchHandler) categoryNames(c *gin.Context, hits []searchHit) (map[primitive.ObjectID]string, bool) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	names := map[primitive.ObjectID]string{}
+	ids := []primitive.ObjectID{}
+	for _, hit := range hits {
+		if !hit.Category.IsZero() {
+			ids = append(ids, hit.Category)
+		}
+	}
+	if len(ids) == 0 {
+		return names, true
+	}
+
+	var categories []models.Category
+	cur, err := handler.categories.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "ledger": ledgerOf(c).ID},
+		options.Find().SetProjection(bson.M{"name": 1}))
+	if err == nil {
+		err = cur.All(ctx, &categories)
+	}
+
+	if dbTimeout(c, err) {
+		return nil, false
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	for _, category := range categories {
+		names[category.ID] = category.Name
+	}
+
+	return names, true
+}
+
+// highlight lists the fields of transaction that contain any of terms.
+// Matching is case-insensitive substring matching, so a text index hit
+// through stemming, like "dinner" for "dinners", is only highlighted where
+// the term itself appears.
+func highlight(transaction models.Transaction, category string, terms []string) []Highlight {
+	type field struct{ name, text string }
+	fields := []field{
+		{"description", transaction.Description},
+		{"payee", transaction.Payee},
+		{"notes", transaction.Notes},
+		{"category", category},
+	}
+	for _, tag := range transaction.Tags {
+		fields = append(fields, field{"tags", tag})
+	}
+
+	highlights := []Highlight{}
+	for _, f := range fields {
+		if matches := findTerms(f.text, terms); len(matches) > 0 {
+			highlights = append(highlights, Highlight{Field: f.name, Text: f.text, Matches: matches})
+		}
+	}
+
+	return highlights
+}
+
+// findTerms returns the rune ranges of text that match any of terms. Runes
+// are compared with strings.EqualFold so the offsets are those of text
+// itself, whatever lowercasing would do to its length.
+func findTerms(text string, terms []string) []Match {
+	runes := []rune(text)
+
+	covered := make([]bool, len(runes))
+	for _, term := range terms {
+		termRunes := []rune(term)
+		if len(termRunes) == 0 {
+			continue
+		}
+		for i := 0; i+len(termRunes) <= len(runes); {
+			if !strings.EqualFold(string(runes[i:i+len(termRunes)]), term) {
+				i++
+				continue
+			}
+			for j := i; j < i+len(termRunes); j++ {
+				covered[j] = true
+			}
+			i += len(termRunes)
+		}
+	}
+
+	matches := []Match{}
+	for i := 0; i < len(runes); {
+		if !covered[i] {
+			i++
+			continue
+		}
+		end := i
+		for end < len(runes) && covered[end] {
+			end++
+		}
+		matches = append(matches, Match{Start: i, End: end})
+		i = end
+	}
+
+	return matches
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"expense-tracker-api/models"
+	"expense-tracker-api/signing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Sessions issues and validates the JWTs that authenticate API calls and
+// resolves them to a Principal.
+type Sessions struct {
+	keys       *signing.KeySet
+	principals *principalCache
+	apiKeys    *mongo.Collection
+	issuer     string
+	audience   string
+	ttl        time.Duration
+}
+
+func NewSessions(keys *signing.KeySet, users *mongo.Collection, apiKeys *mongo.Collection, issuer string, audience string, ttl time.Duration) *Sessions {
+	return &Sessions{
+		keys:       keys,
+		principals: newPrincipalCache(users, 30*time.Second, 10000),
+		apiKeys:    apiKeys,
+		issuer:     issuer,
+		audience:   audience,
+		ttl:        ttl,
+	}
+}
+
+func (sessions *Sessions) issue(user models.User) (JWTOutput, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return JWTOutput{}, err
+	}
+
+	now := time.Now()
+	expirationTime := now.Add(sessions.ttl)
+	claims := &Claims{
+		Email: user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.Hex(),
+			Issuer:    sessions.issuer,
+			Audience:  jwt.ClaimStrings{sessions.audience},
+			ID:        hex.EncodeToString(jti),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+		},
+	}
+
+	tokenString, err := sessions.keys.Sign(claims)
+	if err != nil {
+		return JWTOutput{}, err
+	}
+
+	return JWTOutput{
+		Token:   tokenString,
+		Expires: expirationTime,
+	}, nil
+}
+
+// bearerToken extracts the token from an Authorization header. The
+// "Bearer " prefix is optional for older clients.
+func bearerToken(header string) string {
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// parse verifies the signature, expiry, issuer and audience of a session
+// token.
+func (sessions *Sessions) parse(header string) (*Claims, error) {
+	tokenValue := bearerToken(header)
+	if tokenValue == "" {
+		return nil, errors.New("missing token")
+	}
+
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(tokenValue, claims, sessions.keys.Keyfunc); err != nil {
+		return nil, err
+	}
+
+	if !claims.VerifyIssuer(sessions.issuer, true) || !claims.VerifyAudience(sessions.audience, true) {
+		return nil, errors.New("token is not meant for this API")
+	}
+
+	if claims.Subject == "" || claims.IssuedAt == nil {
+		return nil, errors.New("token is missing claims")
+	}
+
+	return claims, nil
+}
+
+var (
+	errUnknownUser   = errors.New("user no longer exists")
+	errUnknownAPIKey = errors.New("API key is invalid, expired or revoked")
+)
+
+// authenticate resolves the bearer token in header, a session JWT or an
+// API key, to the caller.
+func (sessions *Sessions) authenticate(ctx context.Context, header string) (Principal, error) {
+	if token := bearerToken(header); strings.HasPrefix(token, apiKeyPrefix) {
+		return sessions.authenticateAPIKey(ctx, token)
+	}
+
+	claims, err := sessions.parse(header)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	principal, err := sessions.principals.resolve(ctx, userID)
+	if err == mongo.ErrNoDocuments {
+		return Principal{}, errUnknownUser
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+
+	principal.Scopes = allScopes
+	return principal, nil
+}
+
+// JWKS publishes the public keys that verify session tokens.
+func (sessions *Sessions) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, sessions.keys.JWKS())
+}
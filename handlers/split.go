@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/metrics"
+	"expense-tracker-api/models"
+	"expense-tracker-api/splits"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errNotMember          = errors.New("payer and participants must be members of the ledger")
+	errDuplicateSplit     = errors.New("a participant can only appear once in a split")
+	errSettlementSplit    = errors.New("a settlement pays back exactly one other member")
+	errSplitAmountChanged = errors.New("the amount of a split transaction can only be changed with PUT")
+)
+
+// MemberBalance is positive when the member is owed money. Former is set
+// for someone who has left the ledger but still owes or is owed.
+type MemberBalance struct {
+	User   primitive.ObjectID `json:"user"`
+	Net    int                `json:"net"`
+	Former bool               `json:"former,omitempty"`
+}
+
+type Balances struct {
+	Members []MemberBalance `json:"members"`
+	Debts   []splits.Debt   `json:"debts"`
+}
+
+// prepareSplit checks the split against the selected ledger and fills in
+// what each participant owes. The payer defaults to the caller.
+func prepareSplit(c *gin.Context, transaction *models.Transaction) error {
+	if transaction.Type == "" {
+		transaction.Type = models.TransactionExpense
+	}
+
+	if transaction.Split == nil {
+		if transaction.Type == models.TransactionSettlement {
+			return errSettlementSplit
+		}
+		transaction.PaidBy = primitive.NilObjectID
+		return nil
+	}
+
+	ledger := ledgerOf(c)
+	if transaction.PaidBy.IsZero() {
+		transaction.PaidBy = principalOf(c).UserID
+	}
+
+	if !ledger.member(transaction.PaidBy) {
+		return errNotMember
+	}
+
+	seen := map[primitive.ObjectID]bool{}
+	values := make([]float64, len(transaction.Split.Participants))
+	for i, participant := range transaction.Split.Participants {
+		if !ledger.member(participant.User) {
+			return errNotMember
+		}
+		if seen[participant.User] {
+			return errDuplicateSplit
+		}
+		seen[participant.User] = true
+		values[i] = participant.Value
+	}
+
+	if transaction.Type == models.TransactionSettlement &&
+		(len(values) != 1 || seen[transaction.PaidBy] || transaction.Split.Method != splits.Exact) {
+		return errSettlementSplit
+	}
+
+	owed, err := splits.Compute(transaction.Amount, transaction.Split.Method, values)
+	if err != nil {
+		return err
+	}
+
+	for i := range transaction.Split.Participants {
+		transaction.Split.Participants[i].Owed = owed[i]
+	}
+
+	return nil
+}
+
+// GetBalances reports who owes whom in the selected ledger. Debts are
+// simplified to as few payments as possible unless simplify=false, which
+// lists the balance between each pair of members instead.
+func (handler *TransactionHandler) GetBalances(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"ledger", ledgerOf(c).ID}, {"deletedAt", nil}, {"split", bson.D{{"$exists", true}}}}}},
+		{{"$unwind", "$split.participants"}},
+		{{"$match", bson.D{{"$expr", bson.D{{"$ne", bson.A{"$split.participants.user", "$paidBy"}}}}}}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"from", "$split.participants.user"}, {"to", "$paidBy"}}},
+			{"amount", bson.D{{"$sum", "$split.participants.owed"}}},
+		}}},
+		{{"$project", bson.D{{"_id", 0}, {"from", "$_id.from"}, {"to", "$_id.to"}, {"amount", 1}}}},
+	}
+
+	cur, err := handler.collection.Aggregate(ctx, pipeline)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var debts []splits.Debt
+	if err := cur.All(ctx, &debts); err != nil {
+		if dbTimeout(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	balances := Balances{Members: []MemberBalance{}}
+	net := splits.Net(debts)
+	current := map[primitive.ObjectID]bool{}
+	for _, member := range ledgerOf(c).Members {
+		current[member] = true
+		balances.Members = append(balances.Members, MemberBalance{User: member, Net: net[member]})
+	}
+
+	// Debts stay when someone leaves, so list everyone who appears in them.
+	var former []MemberBalance
+	for user, amount := range net {
+		if !current[user] {
+			former = append(former, MemberBalance{User: user, Net: amount, Former: true})
+		}
+	}
+	sort.Slice(former, func(i, j int) bool { return former[i].User.Hex() < former[j].User.Hex() })
+	balances.Members = append(balances.Members, former...)
+
+	if simplify, err := strconv.ParseBool(c.DefaultQuery("simplify", "true")); err == nil && !simplify {
+		balances.Debts = splits.Pairwise(debts)
+	} else {
+		balances.Debts = splits.Simplify(debts)
+	}
+
+	c.JSON(http.StatusOK, balances)
+}
+
+// SettleUp records a payment between two members as a settlement
+// transaction, which reduces what From owes To.
+func (handler *TransactionHandler) SettleUp(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var settlement models.Settlement
+
+	if err := c.ShouldBindJSON(&settlement); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	const shortForm = "2006-01-02"
+	dt, err := time.Parse(shortForm, settlement.Date)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date should be YYYY-MM-DD"})
+		return
+	}
+
+	transaction := models.Transaction{
+		ID:     primitive.NewObjectID(),
+		Amount: settlement.Amount,
+		Owner:  principalOf(c).UserID,
+		Ledger: ledgerOf(c).ID,
+		InvDt:  primitive.NewDateTimeFromTime(dt),
+		Date:   settlement.Date,
+		Type:   models.TransactionSettlement,
+		PaidBy: settlement.From,
+		Split: &models.Split{
+			Method:       splits.Exact,
+			Participants: []models.SplitParticipant{{User: settlement.To, Value: float64(settlement.Amount)}},
+		},
+		Version: 1,
+	}
+
+	if err := prepareSplit(c, &transaction); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = handler.collection.InsertOne(ctx, transaction)
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = handler.userCollection.UpdateOne(ctx, bson.M{
+		"_id": transaction.Owner,
+	}, bson.D{{"$push", bson.D{
+		{"transactions", transaction.ID},
+	}}})
+
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordCreate(ctx, c, handler.auditLog, audit.Transaction, transaction.ID, transaction)
+	metrics.TransactionsCreated.Inc()
+	setETag(c, transaction.Version)
+	c.JSON(http.StatusCreated, transaction)
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"expense-tracker-api/audit"
+	"expense-tracker-api/metrics"
 	"expense-tracker-api/models"
 	"net/http"
 	"strconv"
@@ -10,80 +12,94 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/net/context"
 )
 
 type TransactionHandler struct {
 	collection     *mongo.Collection
+	categories     *mongo.Collection
 	userCollection *mongo.Collection
-	ctx            context.Context
+	auditLog       *audit.Log
+	timeouts       Timeouts
 }
 
-func NewTransactionHandler(ctx context.Context, collection *mongo.Collection, usrCollection *mongo.Collection) *TransactionHandler {
+func NewTransactionHandler(timeouts Timeouts, collection *mongo.Collection, categories *mongo.Collection, usrCollection *mongo.Collection, auditLog *audit.Log) *TransactionHandler {
 	return &TransactionHandler{
 		collection:     collection,
+		categories:     categories,
 		userCollection: usrCollection,
-		ctx:            ctx,
+		auditLog:       auditLog,
+		timeouts:       timeouts,
 	}
 }
 
 func (handler *TransactionHandler) CreateTransaction(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
 	var transaction models.Transaction
-	var user models.User
-	email := c.MustGet("email")
 
 	if err := c.ShouldBindJSON(&transaction); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	userErr := handler.userCollection.FindOne(handler.ctx, bson.M{
-		"email": email,
-	}).Decode(&user)
+	if err := prepareSplit(c, &transaction); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	if userErr != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"user": userErr.Error()})
+	if !transaction.Category.IsZero() && !categoryInLedger(ctx, c, handler.categories, transaction.Category) {
 		return
 	}
 
+	principal := principalOf(c)
+
 	transaction.ID = primitive.NewObjectID()
-	transaction.Owner = user.ID
+	transaction.Owner = principal.UserID
+	transaction.Ledger = ledgerOf(c).ID
+	transaction.DeletedAt = nil
+	transaction.Version = 1
 	const shortForm = "2006-01-02"
 	dt, _ := time.Parse(shortForm, transaction.Date)
 	transaction.InvDt = primitive.NewDateTimeFromTime(dt)
-	createdTransaction, createErr := handler.collection.InsertOne(handler.ctx, transaction)
+	createdTransaction, createErr := handler.collection.InsertOne(ctx, transaction)
+
+	if dbTimeout(c, createErr) {
+		return
+	}
 
-	_, updateErr := handler.userCollection.UpdateOne(handler.ctx, bson.M{
-		"email": email,
+	if createErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error while creating new transaction"})
+		return
+	}
+
+	_, updateErr := handler.userCollection.UpdateOne(ctx, bson.M{
+		"_id": principal.UserID,
 	}, bson.D{{"$push", bson.D{
 		{"transactions", createdTransaction.InsertedID},
 	}}})
 
-	if updateErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": updateErr.Error()})
+	if dbTimeout(c, updateErr) {
 		return
 	}
 
-	if createErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error while creating new category"})
+	if updateErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": updateErr.Error()})
 		return
 	}
 
+	recordCreate(ctx, c, handler.auditLog, audit.Transaction, transaction.ID, transaction)
+	metrics.TransactionsCreated.Inc()
+	setETag(c, transaction.Version)
 	c.JSON(http.StatusOK, transaction)
 }
 
 func (handler *TransactionHandler) ListTransaction(c *gin.Context) {
-	limit := c.Query("limit")
-	var user models.User
-	email := c.MustGet("email")
-	userErr := handler.userCollection.FindOne(handler.ctx, bson.M{
-		"email": email,
-	}).Decode(&user)
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
 
-	if userErr != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"user": userErr.Error()})
-		return
-	}
+	limit := c.Query("limit")
+	ledger := ledgerOf(c)
 
 	limitInt, _ := strconv.Atoi(limit)
 	if limitInt == 0 {
@@ -92,65 +108,68 @@ func (handler *TransactionHandler) ListTransaction(c *gin.Context) {
 
 	// TODO: remove owner from response
 	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"ledger", bson.D{{"$eq", ledger.ID}}}, {"deletedAt", nil}}}},
 		{{"$sort", bson.D{
+			{"invdt", -1},
 			{"_id", -1},
 		}}},
-		{{"$match", bson.D{{"owner", bson.D{{"$eq", user.ID}}}}}},
-		{{"$lookup", bson.D{
-			{"from", "categories"},
-			{"localField", "category"},
-			{"foreignField", "_id"},
-			{"as", "cat"},
-		}}},
+		categoryLookup(ledger.ID, "category", "cat"),
 		{{"$limit", limitInt}},
 	}
 
-	cur, err := handler.collection.Aggregate(handler.ctx, pipeline)
+	cur, err := handler.collection.Aggregate(ctx, pipeline)
+
+	if dbTimeout(c, err) {
+		return
+	}
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	defer cur.Close(handler.ctx)
+	defer cur.Close(ctx)
 	transactions := make([]models.Transaction, 0)
 
-	for cur.Next(handler.ctx) {
+	for cur.Next(ctx) {
 		var transaction models.Transaction
 		cur.Decode(&transaction)
 		transactions = append(transactions, transaction)
 	}
 
+	if dbTimeout(c, cur.Err()) {
+		return
+	}
+
 	c.JSON(http.StatusOK, transactions)
 }
 
 func (handler *TransactionHandler) DeleteTransaction(c *gin.Context) {
-	email := c.MustGet("email")
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
 	id := c.Param("id")
 	objectId, _ := primitive.ObjectIDFromHex(id)
 
-	_, err := handler.collection.DeleteOne(handler.ctx, bson.D{{"_id", objectId}})
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
-		return
-	}
-
-	_, updateErr := handler.userCollection.UpdateOne(handler.ctx, bson.M{
-		"email": email,
-	}, bson.D{{"$pull", bson.D{
-		{"transactions", objectId},
-	}}})
+	// Deleted transactions go to the trash until Trash purges them.
+	var transaction models.Transaction
+	before, after, err := versionedUpdate(ctx, c, handler.collection, bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil},
+		bson.D{{"$set", bson.D{{"deletedAt", time.Now()}}}}, &transaction)
 
-	if updateErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": updateErr.Error()})
+	if handler.updateFailed(c, err) {
 		return
 	}
 
+	record(ctx, c, handler.auditLog, audit.Transaction, objectId, audit.Delete, audit.Diff(audit.Transaction, before, after))
 	c.JSON(http.StatusOK, gin.H{"message": "Transaction successfully removed"})
 }
 
 func (handler *TransactionHandler) UpdateTransaction(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
 	var transaction models.Transaction
+	var updated models.Transaction
 	id := c.Param("id")
 
 	if err := c.ShouldBindJSON(&transaction); err != nil {
@@ -158,42 +177,62 @@ func (handler *TransactionHandler) UpdateTransaction(c *gin.Context) {
 		return
 	}
 
+	if err := prepareSplit(c, &transaction); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !transaction.Category.IsZero() && !categoryInLedger(ctx, c, handler.categories, transaction.Category) {
+		return
+	}
+
 	const shortForm = "2006-01-02"
 	dt, _ := time.Parse(shortForm, transaction.Date)
 	transaction.InvDt = primitive.NewDateTimeFromTime(dt)
 
-	objectId, _ := primitive.ObjectIDFromHex(id)
-	_, err := handler.collection.UpdateOne(handler.ctx, bson.M{
-		"_id": objectId,
-	}, bson.D{{"$set", bson.D{
+	set := bson.D{
 		{"amount", transaction.Amount},
 		{"category", transaction.Category},
 		{"date", transaction.Date},
-		{"InvDt", transaction.InvDt},
-	}}})
+		{"invdt", transaction.InvDt},
+		{"type", transaction.Type},
+		{"description", transaction.Description},
+		{"payee", transaction.Payee},
+		{"notes", transaction.Notes},
+		{"tags", transaction.Tags},
+	}
+	update := bson.D{{"$set", set}}
+	if transaction.Split != nil {
+		update[0].Value = append(set, bson.E{"paidBy", transaction.PaidBy}, bson.E{"split", transaction.Split})
+	} else {
+		update = append(update, bson.E{"$unset", bson.D{{"paidBy", ""}, {"split", ""}}})
+	}
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	objectId, _ := primitive.ObjectIDFromHex(id)
+	before, after, err := versionedUpdate(ctx, c, handler.collection, bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil}, update, &updated)
+
+	if handler.updateFailed(c, err) {
 		return
 	}
 
+	record(ctx, c, handler.auditLog, audit.Transaction, objectId, audit.Update, audit.Diff(audit.Transaction, before, after))
+
+	setETag(c, updated.Version)
 	c.JSON(http.StatusOK, gin.H{"message": "Transaction was successfully updated"})
 }
 
 func (handler *TransactionHandler) GetTransactionsByCategory(c *gin.Context) {
-	var user models.User
-	email := c.MustGet("email")
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
 
-	userErr := handler.userCollection.FindOne(handler.ctx, bson.M{
-		"email": email,
-	}).Decode(&user)
+	ledger := ledgerOf(c)
 
-	if userErr != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"user": userErr.Error()})
-		return
-	}
-
-	matchStage := bson.D{{"$match", bson.D{{"owner", bson.D{{"$eq", user.ID}}}}}}
+	// Settlements move money between members and are not spending.
+	matchStage := bson.D{{"$match", bson.D{
+		{"ledger", bson.D{{"$eq", ledger.ID}}},
+		{"deletedAt", nil},
+		{"type", bson.D{{"$ne", models.TransactionSettlement}}},
+	}}}
 	group := bson.D{{
 		"$group", bson.D{
 			{
@@ -205,29 +244,138 @@ func (handler *TransactionHandler) GetTransactionsByCategory(c *gin.Context) {
 	pipeline := mongo.Pipeline{
 		matchStage,
 		group,
-		{{"$lookup", bson.D{
-			{"from", "categories"},
-			{"localField", "_id"},
-			{"foreignField", "_id"},
-			{"as", "category"},
-		}}},
+		categoryLookup(ledger.ID, "_id", "category"),
 	}
 
-	cur, err := handler.collection.Aggregate(handler.ctx, pipeline)
+	cur, err := handler.collection.Aggregate(ctx, pipeline)
+
+	if dbTimeout(c, err) {
+		return
+	}
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	defer cur.Close(handler.ctx)
+	defer cur.Close(ctx)
 	transactions := make([]models.TransactionCategory, 0)
 
-	for cur.Next(handler.ctx) {
+	for cur.Next(ctx) {
 		var transaction models.TransactionCategory
 		cur.Decode(&transaction)
 		transactions = append(transactions, transaction)
 	}
 
+	if dbTimeout(c, cur.Err()) {
+		return
+	}
+
 	c.JSON(http.StatusOK, transactions)
 }
+
+func (handler *TransactionHandler) GetTransaction(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	var transaction models.Transaction
+
+	id := c.Param("id")
+	objectId, _ := primitive.ObjectIDFromHex(id)
+
+	err := handler.collection.FindOne(ctx, bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil}).Decode(&transaction)
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+
+	setETag(c, transaction.Version)
+	c.JSON(http.StatusOK, transaction)
+}
+
+var transactionPatchFields = map[string]patchField{
+	"amount":      intField("amount"),
+	"category":    objectIDField("category").optional(),
+	"date":        dateField(),
+	"description": stringField("description", 0, 500).optional(),
+	"payee":       stringField("payee", 0, 200).optional(),
+	"notes":       stringField("notes", 0, 2000).optional(),
+	"tags":        stringListField("tags", 20, 50).optional(),
+}
+
+func (handler *TransactionHandler) PatchTransaction(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	var body map[string]interface{}
+	var transaction models.Transaction
+	id := c.Param("id")
+
+	if ct := c.ContentType(); ct != mergePatchContentType && ct != gin.MIMEJSON {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Use " + mergePatchContentType})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	update, err := buildPatch(body, transactionPatchFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if category, ok := body["category"].(string); ok {
+		// buildPatch has already checked it is an object id.
+		categoryID, _ := primitive.ObjectIDFromHex(category)
+		if !categoryInLedger(ctx, c, handler.categories, categoryID) {
+			return
+		}
+	}
+
+	objectId, _ := primitive.ObjectIDFromHex(id)
+	match := bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil}
+	if _, ok := body["amount"]; ok {
+		// Owed amounts were worked out from the old amount.
+		match["split"] = bson.M{"$exists": false}
+	}
+	before, after, err := versionedUpdate(ctx, c, handler.collection, match, update, &transaction)
+
+	if err == mongo.ErrNoDocuments && match["split"] != nil {
+		count, countErr := handler.collection.CountDocuments(ctx, bson.M{"_id": objectId, "ledger": ledgerOf(c).ID, "deletedAt": nil})
+		if countErr == nil && count > 0 {
+			err = errSplitAmountChanged
+		}
+	}
+
+	if handler.updateFailed(c, err) {
+		return
+	}
+
+	record(ctx, c, handler.auditLog, audit.Transaction, objectId, audit.Update, audit.Diff(audit.Transaction, before, after))
+	setETag(c, transaction.Version)
+	c.JSON(http.StatusOK, transaction)
+}
+
+func (handler *TransactionHandler) updateFailed(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case dbTimeout(c, err):
+	case err == mongo.ErrNoDocuments:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+	case err == errPreconditionFailed:
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case err == errSplitAmountChanged, err == errConcurrentUpdate:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return true
+}
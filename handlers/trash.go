@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/migrations"
+	"expense-tracker-api/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// purgeBatch caps how many documents Purge reads at a time.
+const purgeBatch = 500
+
+// TrashHandler lists and restores soft deleted categories and transactions
+// and purges them for good once they have been in the trash for longer
+// than the retention period.
+type TrashHandler struct {
+	categories   *mongo.Collection
+	transactions *mongo.Collection
+	users        *mongo.Collection
+	attachments  *AttachmentHandler
+	auditLog     *audit.Log
+	retention    time.Duration
+	timeouts     Timeouts
+}
+
+func NewTrashHandler(timeouts Timeouts, categories *mongo.Collection, transactions *mongo.Collection, users *mongo.Collection, attachments *AttachmentHandler, auditLog *audit.Log, retention time.Duration) *TrashHandler {
+	return &TrashHandler{
+		categories:   categories,
+		transactions: transactions,
+		users:        users,
+		attachments:  attachments,
+		auditLog:     auditLog,
+		retention:    retention,
+		timeouts:     timeouts,
+	}
+}
+
+func trashed(ledgerID primitive.ObjectID) bson.M {
+	return bson.M{"ledger": ledgerID, "deletedAt": bson.M{"$ne": nil}}
+}
+
+func (handler *TrashHandler) ListCategories(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	cur, err := handler.categories.Find(ctx, trashed(ledgerOf(c).ID), options.Find().SetSort(bson.D{{"deletedAt", -1}}))
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	categories := make([]models.Category, 0)
+	err = cur.All(ctx, &categories)
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, categories)
+}
+
+func (handler *TrashHandler) ListTransactions(c *gin.Context) {
+	ctx, cancel := handler.timeouts.read(c)
+	defer cancel()
+
+	cur, err := handler.transactions.Find(ctx, trashed(ledgerOf(c).ID), options.Find().SetSort(bson.D{{"deletedAt", -1}}))
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	transactions := make([]models.Transaction, 0)
+	err = cur.All(ctx, &transactions)
+	if dbTimeout(c, err) {
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, transactions)
+}
+
+func (handler *TrashHandler) RestoreCategory(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	objectId, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	filter := trashed(ledgerOf(c).ID)
+	filter["_id"] = objectId
+
+	var category models.Category
+	before, after, err := versionedUpdate(ctx, c, handler.categories, filter,
+		bson.D{{"$set", bson.D{{"deletedAt", nil}}}}, &category)
+
+	switch {
+	case dbTimeout(c, err):
+	case duplicateKey(err, migrations.CategoriesLiveNameIndex):
+		c.JSON(http.StatusConflict, gin.H{"error": "A category with this name already exists"})
+	case err == mongo.ErrNoDocuments:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found in trash"})
+	case err == errPreconditionFailed:
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case err == errConcurrentUpdate:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		record(ctx, c, handler.auditLog, audit.Category, objectId, audit.Restore, audit.Diff(audit.Category, before, after))
+		setETag(c, category.Version)
+		c.JSON(http.StatusOK, category)
+	}
+}
+
+func (handler *TrashHandler) RestoreTransaction(c *gin.Context) {
+	ctx, cancel := handler.timeouts.write(c)
+	defer cancel()
+
+	objectId, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	filter := trashed(ledgerOf(c).ID)
+	filter["_id"] = objectId
+
+	update, ok := handler.restoreTransactionUpdate(ctx, c, filter)
+	if !ok {
+		return
+	}
+
+	var transaction models.Transaction
+	before, after, err := versionedUpdate(ctx, c, handler.transactions, filter, update, &transaction)
+
+	switch {
+	case dbTimeout(c, err):
+	case err == mongo.ErrNoDocuments:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found in trash"})
+	case err == errPreconditionFailed:
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case err == errConcurrentUpdate:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		record(ctx, c, handler.auditLog, audit.Transaction, objectId, audit.Restore, audit.Diff(audit.Transaction, before, after))
+		setETag(c, transaction.Version)
+		c.JSON(http.StatusOK, transaction)
+	}
+}
+
+// restoreTransactionUpdate builds the update that takes the transaction
+// matching filter out of the trash. Its category has to be restored first
+// if it is in the trash too, and is cleared if it has been purged. When the
+// transaction can not be restored it writes the response and returns false.
+func (handler *TrashHandler) restoreTransactionUpdate(ctx context.Context, c *gin.Context, filter bson.M) (bson.D, bool) {
+	update := bson.D{{"$set", bson.D{{"deletedAt", nil}}}}
+
+	var transaction models.Transaction
+	err := handler.transactions.FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"category": 1})).Decode(&transaction)
+
+	if dbTimeout(c, err) {
+		return nil, false
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found in trash"})
+		return nil, false
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if transaction.Category.IsZero() {
+		return update, true
+	}
+
+	var category models.Category
+	err = handler.categories.FindOne(ctx, bson.M{"_id": transaction.Category, "ledger": ledgerOf(c).ID},
+		options.FindOne().SetProjection(bson.M{"deletedAt": 1})).Decode(&category)
+
+	switch {
+	case dbTimeout(c, err):
+		return nil, false
+	case err == mongo.ErrNoDocuments:
+		return append(update, bson.E{"$unset", bson.D{{"category", ""}}}), true
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	case category.DeletedAt != nil:
+		c.JSON(http.StatusConflict, gin.H{"error": "Restore the transaction's category first"})
+		return nil, false
+	}
+
+	return update, true
+}
+
+// Purge permanently removes everything that was deleted before the
+// retention period, together with its attachments and the references
+// users hold to it. Each removal is recorded with the last stored values.
+// Documents are purged purgeBatch at a time.
+func (handler *TrashHandler) Purge(ctx context.Context) error {
+	cutoff := time.Now().Add(-handler.retention)
+
+	for {
+		transactions, err := handler.expired(ctx, handler.transactions, cutoff)
+		if err != nil {
+			return err
+		}
+		if len(transactions) == 0 {
+			break
+		}
+
+		if err := handler.attachments.removeWhere(ctx, bson.M{"transaction": bson.M{"$in": idsOf(transactions)}}); err != nil {
+			return err
+		}
+		if err := handler.purge(ctx, handler.transactions, audit.Transaction, "transactions", transactions); err != nil {
+			return err
+		}
+		if len(transactions) < purgeBatch {
+			break
+		}
+	}
+
+	for {
+		categories, err := handler.expired(ctx, handler.categories, cutoff)
+		if err != nil || len(categories) == 0 {
+			return err
+		}
+
+		if err := handler.purge(ctx, handler.categories, audit.Category, "categories", categories); err != nil {
+			return err
+		}
+		if len(categories) < purgeBatch {
+			return nil
+		}
+	}
+}
+
+// Run purges the trash every interval until ctx is cancelled.
+func (handler *TrashHandler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := handler.Purge(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("purging trash failed", "error", err)
+			}
+		}
+	}
+}
+
+// expired reads the next batch of documents to purge.
+func (handler *TrashHandler) expired(ctx context.Context, collection *mongo.Collection, cutoff time.Time) ([]bson.M, error) {
+	cur, err := collection.Find(ctx, bson.M{"deletedAt": bson.M{"$ne": nil, "$lte": cutoff}},
+		options.Find().SetSort(bson.D{{"_id", 1}}).SetLimit(purgeBatch))
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []bson.M
+	err = cur.All(ctx, &docs)
+	return docs, err
+}
+
+func idsOf(docs []bson.M) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, len(docs))
+	for i, doc := range docs {
+		ids[i], _ = doc["_id"].(primitive.ObjectID)
+	}
+	return ids
+}
+
+// purge deletes docs from collection, pulls them out of the users' field
+// of the same name and records their removal. Every instance purges, so
+// only the one whose delete removed a document records it.
+func (handler *TrashHandler) purge(ctx context.Context, collection *mongo.Collection, resource string, field string, docs []bson.M) error {
+	ids := idsOf(docs)
+
+	_, err := handler.users.UpdateMany(ctx, bson.M{field: bson.M{"$in": ids}},
+		bson.M{"$pull": bson.M{field: bson.M{"$in": ids}}})
+	if err != nil {
+		return err
+	}
+
+	for i, doc := range docs {
+		// Matching deletedAt too leaves it alone if it has been restored.
+		res, err := collection.DeleteOne(ctx, bson.M{"_id": ids[i], "deletedAt": doc["deletedAt"]})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount != 1 {
+			continue
+		}
+
+		entry := audit.Entry{Resource: resource, ResourceID: ids[i], Action: audit.Purge, Changes: audit.Diff(resource, doc, nil)}
+		if ledger, ok := doc["ledger"].(primitive.ObjectID); ok {
+			entry.Ledger = &ledger
+		}
+		if err := handler.auditLog.Record(ctx, entry); err != nil {
+			slog.Error("recording audit entry failed", "resource", resource, "id", ids[i].Hex(), "action", audit.Purge, "error", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"expense-tracker-api/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// currentUser loads the full document of the signed-in user, for handlers
+// that need more than the Principal. When the lookup fails it writes the
+// response and returns false.
+func currentUser(ctx context.Context, c *gin.Context, users *mongo.Collection) (models.User, bool) {
+	var user models.User
+
+	err := users.FindOne(ctx, bson.M{
+		"_id": principalOf(c).UserID,
+	}).Decode(&user)
+
+	if dbTimeout(c, err) {
+		return user, false
+	}
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"user": err.Error()})
+		return user, false
+	}
+
+	return user, true
+}
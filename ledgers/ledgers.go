@@ -0,0 +1,65 @@
+// Package ledgers holds what handlers and migrations share about ledgers:
+// member roles and the personal ledger every user starts with.
+package ledgers
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	Owner  = "owner"
+	Editor = "editor"
+	Viewer = "viewer"
+)
+
+var rank = map[string]int{Viewer: 1, Editor: 2, Owner: 3}
+
+// Allows reports whether role grants at least the rights of min.
+func Allows(role string, min string) bool {
+	return rank[role] >= rank[min]
+}
+
+// Personal returns the id of the user's personal ledger, or
+// mongo.ErrNoDocuments when there is none.
+func Personal(ctx context.Context, collection *mongo.Collection, userID primitive.ObjectID) (primitive.ObjectID, error) {
+	var ledger struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+
+	err := collection.FindOne(ctx, bson.M{"personal": true, "owner": userID},
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&ledger)
+
+	return ledger.ID, err
+}
+
+// EnsurePersonal returns the user's personal ledger, creating it when it
+// is missing. It runs when a user is created. A unique index on personal
+// ledgers' owner makes concurrent calls agree on one ledger.
+func EnsurePersonal(ctx context.Context, collection *mongo.Collection, userID primitive.ObjectID) (primitive.ObjectID, error) {
+	var ledger struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+
+	filter := bson.M{"personal": true, "owner": userID}
+	now := time.Now()
+
+	err := collection.FindOneAndUpdate(ctx, filter, bson.M{"$setOnInsert": bson.M{
+		"_id":       primitive.NewObjectID(),
+		"name":      "Personal",
+		"members":   bson.A{bson.M{"user": userID, "role": Owner, "joinedAt": now}},
+		"createdAt": now,
+	}}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After).SetProjection(bson.M{"_id": 1})).Decode(&ledger)
+
+	if mongo.IsDuplicateKeyError(err) {
+		// Another request created it first.
+		err = collection.FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&ledger)
+	}
+
+	return ledger.ID, err
+}
@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// CommandMonitor logs every Mongo command with its duration at debug
+// level, and failures at warn level, using the logger of the request that
+// issued the command.
+func CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			FromContext(ctx).DebugContext(ctx, "mongo command",
+				"command", e.CommandName,
+				"duration_ms", float64(e.DurationNanos)/float64(time.Millisecond),
+			)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			FromContext(ctx).WarnContext(ctx, "mongo command failed",
+				"command", e.CommandName,
+				"duration_ms", float64(e.DurationNanos)/float64(time.Millisecond),
+				"error", e.Failure,
+			)
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// format renders message as a plain text RFC 5322 email.
+func format(from string, message Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", message.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", message.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer sends through host:port, authenticating with PLAIN auth
+// when username is set.
+func NewSMTPMailer(host string, port int, username string, password string, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPMailer{
+		addr: net.JoinHostPort(host, fmt.Sprint(port)),
+		auth: auth,
+		from: from,
+	}
+}
+
+func (mailer *SMTPMailer) Send(ctx context.Context, message Message) error {
+	return smtp.SendMail(mailer.addr, mailer.auth, mailer.from, []string{message.To}, format(mailer.from, message))
+}
+
+// LogMailer prints emails to the log instead of sending them, for local
+// development.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, message Message) error {
+	slog.InfoContext(ctx, "email", "to", message.To, "subject", message.Subject, "body", message.Body)
+	return nil
+}
+
+// FileMailer writes every email as an .eml file into a directory, for
+// local development and manual testing.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (mailer *FileMailer) Send(ctx context.Context, message Message) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(message.To))
+	return os.WriteFile(filepath.Join(mailer.dir, name), format(mailer.from, message), 0o644)
+}
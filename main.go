@@ -2,73 +2,319 @@ package main
 
 import (
 	"context"
-	"log"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"expense-tracker-api/audit"
+	"expense-tracker-api/blobs"
+	"expense-tracker-api/config"
 	handlers "expense-tracker-api/handlers"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/mailer"
+	"expense-tracker-api/metrics"
+	"expense-tracker-api/migrations"
+	"expense-tracker-api/ratelimit"
+	"expense-tracker-api/routes"
+	"expense-tracker-api/signing"
+	"expense-tracker-api/sso"
+	"expense-tracker-api/tokens"
+	"expense-tracker-api/tracing"
 
-	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-var ctx context.Context
-var err error
-var client *mongo.Client
-var collection *mongo.Collection
+// combineMonitors fans Mongo command events out to several monitors.
+func combineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
+
+// connectMongo retries the initial connection with exponential backoff so
+// the API can start before Mongo is reachable.
+func connectMongo(ctx context.Context, cfg config.Config, monitor *event.CommandMonitor) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MongoURI).SetMonitor(monitor))
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := cfg.ConnectBackoff
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = client.Ping(pingCtx, readpref.Primary())
+		cancel()
+
+		if err == nil {
+			return client, nil
+		}
+
+		if attempt >= cfg.ConnectAttempts {
+			client.Disconnect(ctx)
+			return nil, err
+		}
+
+		slog.Warn("MongoDB not reachable, retrying", "attempt", attempt, "max_attempts", cfg.ConnectAttempts, "retry_in", backoff.String(), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			client.Disconnect(context.Background())
+			return nil, ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > cfg.ConnectMaxBackoff {
+			backoff = cfg.ConnectMaxBackoff
+		}
+	}
+}
+
+func newMailer(cfg config.Config) (mailer.Mailer, error) {
+	switch cfg.Mailer {
+	case "smtp":
+		return mailer.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom), nil
+	case "file":
+		return mailer.NewFileMailer(cfg.MailDir, cfg.MailFrom)
+	case "log":
+		return mailer.LogMailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
+}
 
-var authHandler *handlers.AuthHandler
-var categoriesHandler *handlers.CategoryHandler
-var transactionHandler *handlers.TransactionHandler
+// tokenSecret returns the configured secret or, failing that, a random
+// one so that issued links only stay valid until the next restart.
+func tokenSecret(cfg config.Config) ([]byte, error) {
+	if cfg.TokenSecret != "" {
+		return []byte(cfg.TokenSecret), nil
+	}
+
+	slog.Warn("TOKEN_SECRET is not set, emailed links will not survive a restart")
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	return secret, err
+}
 
-func init() {
-	ctx := context.Background()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
-	if err = client.Ping(context.TODO(), readpref.Primary()); err != nil {
-		log.Fatal(err)
+// keyEncryptionKey decodes the key that encrypts stored signing keys, or
+// returns nil when none is configured.
+func keyEncryptionKey(cfg config.Config) ([]byte, error) {
+	if cfg.JWTKeyEncryptionKey == "" {
+		slog.Warn("JWT_KEY_ENCRYPTION_KEY is not set, signing keys are stored unencrypted")
+		return nil, nil
 	}
-	log.Println("Connected to MongoDB")
 
-	collectionUsers := client.Database("expense").Collection("users")
-	authHandler = handlers.NewAuthHandler(ctx, collectionUsers)
+	return base64.StdEncoding.DecodeString(cfg.JWTKeyEncryptionKey)
+}
+
+// oidcProviders discovers the configured identity providers. One that can
+// not be reached is left out rather than failing startup.
+func oidcProviders(ctx context.Context, cfg config.Config) []*sso.Provider {
+	providers := []*sso.Provider{}
+	for _, settings := range cfg.OIDCProviders {
+		provider, err := sso.NewProvider(ctx, sso.Settings(settings))
+		if err != nil {
+			slog.Error("OIDC provider unavailable", "provider", settings.Name, "error", err)
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
 
-	collectionCategories := client.Database("expense").Collection("categories")
-	collectionTransactions := client.Database("expense").Collection("transactions")
-	log.Print(collectionTransactions)
-	log.Print(collectionCategories)
+func newBlobStore(cfg config.Config, db *mongo.Database) (blobs.Store, error) {
+	switch cfg.BlobStore {
+	case "file":
+		return blobs.NewFileStore(cfg.BlobDir)
+	case "gridfs":
+		return blobs.NewGridFSStore(db, "attachments")
+	}
+	return nil, fmt.Errorf("unknown blob store %q", cfg.BlobStore)
+}
 
-	categoriesHandler = handlers.NewCategoryHandler(ctx, collectionCategories, collectionUsers)
-	transactionHandler = handlers.NewTransactionHandler(ctx, collectionTransactions, collectionUsers)
-	log.Print(transactionHandler)
-	log.Print(categoriesHandler)
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func main() {
-	router := gin.Default()
+	cfg := config.Load()
+	logger := logging.New(cfg.LogLevel)
 
-	router.Use(authHandler.CORSMiddleware())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TracingExporter, cfg.OTLPEndpoint)
+	if err != nil {
+		fatal("tracing setup failed", err)
+	}
 
-	router.POST("/register", authHandler.RegisterUser)
-	router.POST("/signin", authHandler.SignInHandler)
+	monitor := combineMonitors(logging.CommandMonitor(), tracing.CommandMonitor(), metrics.CommandMonitor())
+	client, err := connectMongo(ctx, cfg, monitor)
+	if err != nil {
+		fatal("MongoDB connection failed", err)
+	}
+	logger.Info("Connected to MongoDB")
+
+	db := client.Database(cfg.Database)
+	if err := migrations.Run(ctx, db); err != nil {
+		fatal("migrations failed", err)
+	}
 
-	authorized := router.Group("/")
-	authorized.Use(authHandler.AuthMiddleware())
+	collectionUsers := db.Collection("users")
+	collectionCategories := db.Collection("categories")
+	collectionTransactions := db.Collection("transactions")
+	collectionAPIKeys := db.Collection("api_keys")
 
-	{
-		//Categories
-		authorized.GET("/categories", categoriesHandler.ListCategory)
-		authorized.POST("/create-category", categoriesHandler.CreateCategory)
-		authorized.GET("/category/:id", categoriesHandler.GetCategory)
-		authorized.DELETE("/category/:id", categoriesHandler.DeleteCategory)
-		authorized.PUT("/category/:id", categoriesHandler.UpdateCategory)
+	timeouts := handlers.Timeouts{Read: cfg.DBReadTimeout, Write: cfg.DBWriteTimeout}
+
+	memoryStore := ratelimit.NewMemoryStore()
+	// An hour is what the slowest limit, mail per address, takes to refill.
+	go memoryStore.RunCleanup(ctx, 10*time.Minute, time.Hour)
+
+	lockout := ratelimit.NewMemoryLockout(ratelimit.LockoutPolicy{
+		Threshold: cfg.LockoutThreshold,
+		Base:      cfg.LockoutBase,
+		Max:       cfg.LockoutMax,
+		Forget:    24 * time.Hour,
+	})
+	go lockout.RunCleanup(ctx, 10*time.Minute)
+
+	mail, err := newMailer(cfg)
+	if err != nil {
+		fatal("mailer setup failed", err)
+	}
+
+	secret, err := tokenSecret(cfg)
+	if err != nil {
+		fatal("token secret", err)
+	}
+
+	kek, err := keyEncryptionKey(cfg)
+	if err != nil {
+		fatal("JWT key-encryption key", err)
+	}
+
+	keys, err := signing.NewKeySet(db.Collection("signing_keys"), cfg.JWTAlgorithm, cfg.JWTRotateEvery, cfg.JWTTTL+time.Minute, kek)
+	if err != nil {
+		fatal("JWT signing setup failed", err)
+	}
+
+	if err := keys.Refresh(ctx); err != nil {
+		fatal("loading JWT signing keys failed", err)
+	}
+	go keys.Run(ctx, time.Minute)
+
+	store, err := newBlobStore(cfg, db)
+	if err != nil {
+		fatal("blob store setup failed", err)
+	}
+
+	auditLog := audit.NewLog(db, "audit_log")
+
+	sessions := handlers.NewSessions(keys, collectionUsers, collectionAPIKeys, cfg.JWTIssuer, cfg.JWTAudience, cfg.JWTTTL)
+	accountHandler := handlers.NewAccountHandler(timeouts, collectionUsers, tokens.NewStore(db.Collection("user_tokens")), tokens.NewSigner(secret), mail, cfg.AppBaseURL, auditLog)
+	authHandler := handlers.NewAuthHandler(timeouts, collectionUsers, db.Collection("ledgers"), lockout, sessions, accountHandler, cfg.RequireEmailVerification)
+	attachmentHandler := handlers.NewAttachmentHandler(timeouts, db.Collection("attachments"), collectionTransactions, store, cfg.AttachmentMaxBytes, cfg.AttachmentTypes)
+	ledgerHandler := handlers.NewLedgerHandler(timeouts, db.Collection("ledgers"), db.Collection("ledger_invitations"), collectionCategories, collectionTransactions, attachmentHandler, cfg.AppBaseURL)
+	profileHandler := handlers.NewProfileHandler(timeouts, collectionUsers, sessions, accountHandler, ledgerHandler)
+	mfaHandler := handlers.NewMFAHandler(timeouts, collectionUsers, cfg.MFAIssuer, auditLog)
+	apiKeyHandler := handlers.NewAPIKeyHandler(timeouts, collectionAPIKeys)
+	oidcHandler := handlers.NewOIDCHandler(timeouts, collectionUsers, db.Collection("oidc_flows"), db.Collection("oidc_codes"), oidcProviders(ctx, cfg), authHandler, cfg.OIDCCompleteURL)
+	categoriesHandler := handlers.NewCategoryHandler(timeouts, collectionCategories, collectionUsers, auditLog)
+	transactionHandler := handlers.NewTransactionHandler(timeouts, collectionTransactions, collectionCategories, collectionUsers, auditLog)
+	searchHandler := handlers.NewSearchHandler(timeouts, collectionTransactions, collectionCategories)
+	bulkHandler := handlers.NewBulkHandler(timeouts, collectionTransactions, collectionCategories, auditLog)
+	trashHandler := handlers.NewTrashHandler(timeouts, collectionCategories, collectionTransactions, collectionUsers, attachmentHandler, auditLog, cfg.TrashRetention)
+	auditHandler := handlers.NewAuditHandler(timeouts, auditLog)
+	healthHandler := handlers.NewHealthHandler(client)
+	go trashHandler.Run(ctx, time.Hour)
+
+	router, err := routes.Setup(cfg, logger, routes.Handlers{
+		Auth:         authHandler,
+		Accounts:     accountHandler,
+		Profile:      profileHandler,
+		MFA:          mfaHandler,
+		Sessions:     sessions,
+		APIKeys:      apiKeyHandler,
+		OIDC:         oidcHandler,
+		Ledgers:      ledgerHandler,
+		Categories:   categoriesHandler,
+		Transactions: transactionHandler,
+		Attachments:  attachmentHandler,
+		Search:       searchHandler,
+		Bulk:         bulkHandler,
+		Trash:        trashHandler,
+		Audit:        auditHandler,
+		Health:       healthHandler,
+		RateLimits:   memoryStore,
+	})
+	if err != nil {
+		// Drift is caught by the openapi tests; serving a partial spec
+		// beats refusing to start.
+		logger.Error("OpenAPI spec is out of date", "error", err)
+	}
+
+	server := &http.Server{
+		Addr:     cfg.Addr,
+		Handler:  router,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTP server failed", err)
+		}
+	}()
+	logger.Info("Listening", "addr", cfg.Addr)
+
+	<-ctx.Done()
+	stop()
+	logger.Info("Shutting down, draining in-flight requests")
+	healthHandler.Drain()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("HTTP server shutdown", "error", err)
+	}
+
+	if err := client.Disconnect(shutdownCtx); err != nil {
+		logger.Error("MongoDB disconnect", "error", err)
+	}
 
-		//Transactions
-		authorized.POST("/create-transaction", transactionHandler.CreateTransaction)
-		authorized.GET("/transactions", transactionHandler.ListTransaction)
-		authorized.DELETE("/transaction/:id", transactionHandler.DeleteTransaction)
-		authorized.PUT("/transaction/:id", transactionHandler.UpdateTransaction)
-		authorized.GET("/transaction-by-category", transactionHandler.GetTransactionsByCategory)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("tracing shutdown", "error", err)
 	}
 
-	router.Run(":5050")
+	logger.Info("Server stopped")
 }
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests currently being served.",
+	})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "Mongo command latency by command name and outcome.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"command", "outcome"})
+
+	TransactionsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "transactions_created_total",
+		Help: "Transactions created.",
+	})
+
+	SignIns = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "signins_total",
+		Help: "Successful sign-ins.",
+	})
+
+	SignInFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "signin_failures_total",
+		Help: "Sign-ins rejected because of a wrong email or password.",
+	})
+)
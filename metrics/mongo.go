@@ -0,0 +1,19 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, "success").Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, "failure").Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+	}
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// sessionWindow is how long a user counts as active after their last
+// authenticated request.
+const sessionWindow = 15 * time.Minute
+
+var sessions = &sessionTracker{seen: map[string]time.Time{}}
+
+var activeSessions = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "active_sessions",
+	Help: "Users with an authenticated request in the last 15 minutes.",
+}, func() float64 {
+	return float64(sessions.active(time.Now()))
+})
+
+type sessionTracker struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// TrackSession marks user as active now.
+func TrackSession(user string) {
+	sessions.mu.Lock()
+	sessions.seen[user] = time.Now()
+	sessions.mu.Unlock()
+}
+
+func (tracker *sessionTracker) active(now time.Time) int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	for user, last := range tracker.seen {
+		if now.Sub(last) > sessionWindow {
+			delete(tracker.seen, user)
+		}
+	}
+	return len(tracker.seen)
+}
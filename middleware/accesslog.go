@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"log/slog"
+	"time"
+
+	"expense-tracker-api/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AccessLog writes one structured line per request once it has been
+// handled. It must run after RequestID so the line carries the request ID;
+// the user ID comes with the logger AuthMiddleware stores.
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", status,
+			"duration_ms", float64(time.Since(start)) / float64(time.Millisecond),
+			"client_ip", c.ClientIP(),
+			"bytes", c.Writer.Size(),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+
+		ctx := c.Request.Context()
+		logging.FromContext(ctx).Log(ctx, level, "request", attrs...)
+	}
+}
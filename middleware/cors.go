@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSPolicy describes which cross-origin requests are allowed. Origins
+// are matched exactly, or with a "*" standing for one or more leading
+// subdomain labels ("https://*.example.com"); a lone "*" allows any origin.
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+func (policy CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+
+		prefix, suffix, found := strings.Cut(strings.ToLower(allowed), "*")
+		lower := strings.ToLower(origin)
+		if !found || len(lower) <= len(prefix)+len(suffix) ||
+			!strings.HasPrefix(lower, prefix) || !strings.HasSuffix(lower, suffix) {
+			continue
+		}
+
+		labels := lower[len(prefix) : len(lower)-len(suffix)]
+		if !strings.ContainsAny(labels, "/:@") {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy CORSPolicy) allowsAnyOrigin() bool {
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy CORSPolicy) allowsMethod(method string) bool {
+	for _, allowed := range policy.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy CORSPolicy) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+
+		ok := false
+		for _, allowed := range policy.AllowedHeaders {
+			if allowed == "*" || strings.EqualFold(allowed, header) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// CORS applies policy to every request, or the override registered for
+// the longest matching path prefix.
+func CORS(policy CORSPolicy, overrides map[string]CORSPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := policy
+		matched := -1
+		for prefix, override := range overrides {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) && len(prefix) > matched {
+				p, matched = override, len(prefix)
+			}
+		}
+
+		header := c.Writer.Header()
+		header.Add("Vary", "Origin")
+
+		origin := c.GetHeader("Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		requestedHeaders := c.GetHeader("Access-Control-Request-Headers")
+		if preflight && (!p.allowsMethod(c.GetHeader("Access-Control-Request-Method")) || !p.allowsHeaders(requestedHeaders)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if !p.allowsOrigin(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		// Browsers reject "*" together with credentials, so echo the origin.
+		if p.allowsAnyOrigin() && !p.AllowCredentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(p.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+			}
+			c.Next()
+			return
+		}
+
+		header.Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+		if requestedHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", requestedHeaders)
+		}
+		if p.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+		}
+
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
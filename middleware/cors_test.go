@@ -0,0 +1,285 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+var testPolicy = CORSPolicy{
+	AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"},
+	AllowedMethods: []string{"GET", "POST"},
+	AllowedHeaders: []string{"Authorization", "Content-Type"},
+	ExposedHeaders: []string{"ETag"},
+	MaxAge:         10 * time.Minute,
+}
+
+func TestCORS(t *testing.T) {
+	credentials := testPolicy
+	credentials.AllowedOrigins = []string{"*"}
+	credentials.AllowCredentials = true
+
+	anyOrigin := testPolicy
+	anyOrigin.AllowedOrigins = []string{"*"}
+
+	overrides := map[string]CORSPolicy{
+		"/public":   {AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}},
+		"/internal": {},
+	}
+
+	tests := []struct {
+		name      string
+		policy    CORSPolicy
+		overrides map[string]CORSPolicy
+		method    string
+		path      string
+		headers   map[string]string
+		status    int
+		// want maps response headers to their expected value, "" meaning
+		// the header must be absent.
+		want map[string]string
+	}{
+		{
+			name:    "exact origin",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			status:  http.StatusOK,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":   "https://app.example.com",
+				"Access-Control-Expose-Headers": "ETag",
+			},
+		},
+		{
+			name:    "exact origin ignores case",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "https://APP.example.com"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": "https://APP.example.com"},
+		},
+		{
+			name:    "other origin",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "https://evil.com"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Expose-Headers": ""},
+		},
+		{
+			name:    "wildcard subdomain",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "https://shop.example.org"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": "https://shop.example.org"},
+		},
+		{
+			name:    "wildcard nested subdomains",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "https://a.b.example.org"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": "https://a.b.example.org"},
+		},
+		{
+			name:    "wildcard needs a subdomain",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "https://example.org"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:    "wildcard does not match a look-alike domain",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "https://evil-example.org"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:    "wildcard does not match another scheme",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "http://shop.example.org"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:    "wildcard does not span a port or userinfo",
+			policy:  testPolicy,
+			headers: map[string]string{"Origin": "https://evil.com:1@x.example.org"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:    "any origin without credentials",
+			policy:  anyOrigin,
+			headers: map[string]string{"Origin": "https://anywhere.net"},
+			status:  http.StatusOK,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "",
+			},
+		},
+		{
+			name:    "credentials echo the origin",
+			policy:  credentials,
+			headers: map[string]string{"Origin": "https://anywhere.net"},
+			status:  http.StatusOK,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://anywhere.net",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{
+			name:   "no origin",
+			policy: testPolicy,
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "preflight",
+			policy: testPolicy,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  "POST",
+				"Access-Control-Request-Headers": "content-type, authorization",
+			},
+			status: http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET, POST",
+				"Access-Control-Allow-Headers": "content-type, authorization",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			name:   "preflight with a rejected method",
+			policy: testPolicy,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "DELETE",
+			},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name:   "preflight with a rejected header",
+			policy: testPolicy,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  "GET",
+				"Access-Control-Request-Headers": "Authorization, X-Secret",
+			},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Headers": ""},
+		},
+		{
+			name:   "preflight from a rejected origin",
+			policy: testPolicy,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                        "https://evil.com",
+				"Access-Control-Request-Method": "GET",
+			},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:      "override for a path prefix",
+			policy:    testPolicy,
+			overrides: overrides,
+			path:      "/public/spec",
+			headers:   map[string]string{"Origin": "https://evil.com"},
+			status:    http.StatusOK,
+			want:      map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+		{
+			name:      "override rejects what the default allows",
+			policy:    testPolicy,
+			overrides: overrides,
+			path:      "/internal",
+			headers:   map[string]string{"Origin": "https://app.example.com"},
+			status:    http.StatusOK,
+			want:      map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:      "override methods apply to preflights",
+			policy:    testPolicy,
+			overrides: overrides,
+			method:    http.MethodOptions,
+			path:      "/public/spec",
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "POST",
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:      "default policy outside the overrides",
+			policy:    testPolicy,
+			overrides: overrides,
+			path:      "/api",
+			headers:   map[string]string{"Origin": "https://evil.com"},
+			status:    http.StatusOK,
+			want:      map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name: "longest override wins",
+			overrides: map[string]CORSPolicy{
+				"/api":        {AllowedOrigins: []string{"https://app.example.com"}},
+				"/api/public": {AllowedOrigins: []string{"*"}},
+			},
+			path:    "/api/public/x",
+			headers: map[string]string{"Origin": "https://evil.com"},
+			status:  http.StatusOK,
+			want:    map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, path := test.method, test.path
+			if method == "" {
+				method = http.MethodGet
+			}
+			if path == "" {
+				path = "/"
+			}
+
+			router := gin.New()
+			router.Use(CORS(test.policy, test.overrides))
+			router.Handle(method, path, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(method, path, nil)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+
+			for name, want := range test.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+
+			vary := strings.Join(w.Header().Values("Vary"), ", ")
+			if !strings.Contains(vary, "Origin") {
+				t.Errorf("Vary = %q, want it to include Origin", vary)
+			}
+			if method == http.MethodOptions && !strings.Contains(vary, "Access-Control-Request-Method") {
+				t.Errorf("Vary = %q, want it to include Access-Control-Request-Method", vary)
+			}
+		})
+	}
+}
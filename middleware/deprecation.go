@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deprecated marks a legacy route with the Deprecation and Sunset headers
+// and links to the successor route, whose ":param" segments are filled in
+// from the current request.
+func Deprecated(successor string, since time.Time, sunset time.Time) gin.HandlerFunc {
+	deprecation := fmt.Sprintf("@%d", since.Unix())
+	sunsetDate := sunset.UTC().Format(http.TimeFormat)
+
+	return func(c *gin.Context) {
+		segments := strings.Split(successor, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				segments[i] = c.Param(segment[1:])
+			}
+		}
+
+		c.Header("Deprecation", deprecation)
+		c.Header("Sunset", sunsetDate)
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", strings.Join(segments, "/")))
+		c.Next()
+	}
+}
@@ -0,0 +1,100 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+
+	"expense-tracker-api/ledgers"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// backfillLedgers gives every existing user a personal ledger and moves
+// the categories and transactions they own into it.
+func backfillLedgers(ctx context.Context, db *mongo.Database) error {
+	cur, err := db.Collection("users").Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var user struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+
+		ledgerID, err := ledgers.EnsurePersonal(ctx, db.Collection("ledgers"), user.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, collection := range []string{"categories", "transactions"} {
+			_, err := db.Collection(collection).UpdateMany(ctx,
+				bson.M{"owner": user.ID, "ledger": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"ledger": ledgerID}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return cur.Err()
+}
+
+// backfillPersonalLedgers gives a personal ledger to users who registered
+// after backfillLedgers ran but never made a request, which is when it used
+// to be created. New users get theirs when they are created.
+func backfillPersonalLedgers(ctx context.Context, db *mongo.Database) error {
+	cur, err := db.Collection("users").Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var user struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+
+		if _, err := ledgers.EnsurePersonal(ctx, db.Collection("ledgers"), user.ID); err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+// dropIndex removes an index, succeeding when it is already gone.
+func dropIndex(collection string, name string) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).Indexes().DropOne(ctx, name)
+
+		var commandErr mongo.CommandError
+		if errors.As(err, &commandErr) && (commandErr.Code == 27 || commandErr.Code == 26) {
+			// IndexNotFound, NamespaceNotFound
+			return nil
+		}
+		return err
+	}
+}
+
+// steps runs several migration functions in order.
+func steps(up ...func(ctx context.Context, db *mongo.Database) error) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		for _, step := range up {
+			if err := step(ctx, db); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
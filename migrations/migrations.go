@@ -0,0 +1,157 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is a versioned change to the database. Up must be idempotent:
+// two instances starting together may both run it before either records
+// the version.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+type record struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+const collectionName = "migrations"
+
+// Run applies every migration that is not yet recorded, in version order.
+func Run(ctx context.Context, db *mongo.Database) error {
+	return apply(ctx, db, all)
+}
+
+func apply(ctx context.Context, db *mongo.Database, migrations []Migration) error {
+	collection := db.Collection(collectionName)
+
+	cur, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+
+	var applied []record
+	if err := cur.All(ctx, &applied); err != nil {
+		return err
+	}
+
+	done := map[int]bool{}
+	for _, r := range applied {
+		done[r.Version] = true
+	}
+
+	for _, migration := range migrations {
+		if done[migration.Version] {
+			continue
+		}
+
+		slog.InfoContext(ctx, "applying migration", "version", migration.Version, "description", migration.Description)
+		if err := migration.Up(ctx, db); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+
+		_, err := collection.InsertOne(ctx, record{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   time.Now(),
+		})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createIndexes(collection string, indexes ...mongo.IndexModel) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).Indexes().CreateMany(ctx, indexes)
+		return err
+	}
+}
+
+func unique(name string, keys bson.D) mongo.IndexModel {
+	return mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name).SetUnique(true)}
+}
+
+func index(name string, keys bson.D) mongo.IndexModel {
+	return mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name)}
+}
+
+// expireAt removes documents once the date in the indexed field has passed.
+func expireAt(name string, keys bson.D) mongo.IndexModel {
+	return mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name).SetExpireAfterSeconds(0)}
+}
+
+// text is a text index; weights rank matches in some fields above others.
+func text(name string, keys bson.D, weights bson.D) mongo.IndexModel {
+	return mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name).SetWeights(weights)}
+}
+
+// uniqueWhere is a unique index over the documents matching filter only.
+func uniqueWhere(name string, keys bson.D, filter bson.D) mongo.IndexModel {
+	return mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name).SetUnique(true).SetPartialFilterExpression(filter)}
+}
+
+// maxReportedDuplicates caps how many conflicting values an error lists.
+const maxReportedDuplicates = 10
+
+// noDuplicates fails when documents in collection share the same values
+// for fields, listing the conflicting ones. It runs before a unique index
+// is created on fields, so that the migration stops with an error an
+// operator can act on rather than a bare duplicate key error. Duplicates
+// are left for the operator to resolve because only they know which
+// document should keep the value.
+func noDuplicates(collection string, fields ...string) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		key := bson.D{}
+		for _, field := range fields {
+			key = append(key, bson.E{field, "$" + field})
+		}
+
+		cur, err := db.Collection(collection).Aggregate(ctx, mongo.Pipeline{
+			{{"$group", bson.D{{"_id", key}, {"ids", bson.D{{"$push", "$_id"}}}, {"count", bson.D{{"$sum", 1}}}}}},
+			{{"$match", bson.D{{"count", bson.D{{"$gt", 1}}}}}},
+			{{"$sort", bson.D{{"count", -1}}}},
+		}, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return err
+		}
+
+		var groups []struct {
+			Key bson.M        `bson:"_id"`
+			IDs []interface{} `bson:"ids"`
+		}
+		if err := cur.All(ctx, &groups); err != nil {
+			return err
+		}
+
+		if len(groups) == 0 {
+			return nil
+		}
+
+		conflicts := []string{}
+		for i, group := range groups {
+			if i == maxReportedDuplicates {
+				conflicts = append(conflicts, fmt.Sprintf("and %d more", len(groups)-i))
+				break
+			}
+			conflicts = append(conflicts, fmt.Sprintf("%v shared by %v", group.Key, group.IDs))
+		}
+
+		return fmt.Errorf("%s has %d sets of documents with the same %s, resolve them before the unique index can be created: %s",
+			collection, len(groups), strings.Join(fields, " and "), strings.Join(conflicts, "; "))
+	}
+}
@@ -0,0 +1,17 @@
+package migrations
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// backfillDeletedAt stores an explicit null deletedAt on categories so the
+// partial unique name index covers every category that is not in the trash.
+func backfillDeletedAt(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("categories").UpdateMany(ctx,
+		bson.M{"deletedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deletedAt": nil}})
+	return err
+}
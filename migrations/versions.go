@@ -0,0 +1,167 @@
+package migrations
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Index names are matched by the handlers to tell duplicate key errors apart.
+const (
+	UsersEmailIndex           = "users_email_unique"
+	UsersUsernameIndex        = "users_username_unique"
+	APIKeysHashIndex          = "api_keys_hash_unique"
+	CategoriesOwnerNameIndex  = "categories_owner_name_unique"
+	CategoriesLedgerNameIndex = "categories_ledger_name_unique"
+	CategoriesLiveNameIndex   = "categories_ledger_name_live_unique"
+	LedgersPersonalIndex      = "ledgers_personal_owner_unique"
+)
+
+// all lists every migration. Append new ones with the next version and
+// never edit or reorder a released migration.
+var all = []Migration{
+	{
+		Version:     1,
+		Description: "unique indexes on users.email and users.username",
+		Up: steps(
+			noDuplicates("users", "email"),
+			noDuplicates("users", "username"),
+			createIndexes("users",
+				unique(UsersEmailIndex, bson.D{{"email", 1}}),
+				unique(UsersUsernameIndex, bson.D{{"username", 1}}),
+			),
+		),
+	},
+	{
+		Version:     2,
+		Description: "unique category name per owner",
+		Up: steps(
+			noDuplicates("categories", "owner", "name"),
+			createIndexes("categories",
+				unique(CategoriesOwnerNameIndex, bson.D{{"owner", 1}, {"name", 1}}),
+			),
+		),
+	},
+	{
+		Version:     3,
+		Description: "transactions by owner and date",
+		Up: createIndexes("transactions",
+			index("transactions_owner_invdt", bson.D{{"owner", 1}, {"invdt", -1}}),
+		),
+	},
+	{
+		Version:     4,
+		Description: "expire user tokens",
+		Up: createIndexes("user_tokens",
+			expireAt("user_tokens_expires", bson.D{{"expiresAt", 1}}),
+		),
+	},
+	{
+		Version:     5,
+		Description: "API keys by hash and by owner",
+		Up: createIndexes("api_keys",
+			unique(APIKeysHashIndex, bson.D{{"hash", 1}}),
+			index("api_keys_owner_created", bson.D{{"owner", 1}, {"createdAt", -1}}),
+		),
+	},
+	{
+		Version:     6,
+		Description: "unique OIDC identity per user",
+		Up: createIndexes("users",
+			uniqueWhere("users_identities_unique", bson.D{{"identities.key", 1}},
+				bson.D{{"identities.key", bson.D{{"$exists", true}}}}),
+		),
+	},
+	{
+		Version:     7,
+		Description: "expire OIDC login flows",
+		Up: createIndexes("oidc_flows",
+			expireAt("oidc_flows_expires", bson.D{{"expiresAt", 1}}),
+		),
+	},
+	{
+		Version:     8,
+		Description: "ledgers by member and one personal ledger per user",
+		Up: createIndexes("ledgers",
+			uniqueWhere(LedgersPersonalIndex, bson.D{{"owner", 1}}, bson.D{{"personal", true}}),
+			index("ledgers_members_user", bson.D{{"members.user", 1}}),
+		),
+	},
+	{
+		Version:     9,
+		Description: "move categories and transactions into personal ledgers",
+		Up:          backfillLedgers,
+	},
+	{
+		Version:     10,
+		Description: "scope category names and transaction dates to the ledger",
+		Up: steps(
+			dropIndex("categories", CategoriesOwnerNameIndex),
+			createIndexes("categories",
+				unique(CategoriesLedgerNameIndex, bson.D{{"ledger", 1}, {"name", 1}}),
+			),
+			createIndexes("transactions",
+				index("transactions_ledger_invdt", bson.D{{"ledger", 1}, {"invdt", -1}}),
+			),
+		),
+	},
+	{
+		Version:     11,
+		Description: "ledger invitations by hash, expiring",
+		Up: createIndexes("ledger_invitations",
+			unique("ledger_invitations_hash_unique", bson.D{{"hash", 1}}),
+			expireAt("ledger_invitations_expires", bson.D{{"expiresAt", 1}}),
+		),
+	},
+	{
+		Version:     12,
+		Description: "attachments by ledger and transaction",
+		Up: createIndexes("attachments",
+			index("attachments_ledger_transaction", bson.D{{"ledger", 1}, {"transaction", 1}, {"createdAt", 1}}),
+		),
+	},
+	{
+		Version:     13,
+		Description: "text search over transactions within a ledger",
+		Up: createIndexes("transactions",
+			text("transactions_text",
+				bson.D{{"ledger", 1}, {"description", "text"}, {"payee", "text"}, {"notes", "text"}, {"tags", "text"}},
+				bson.D{{"description", 5}, {"payee", 3}, {"tags", 3}, {"notes", 1}}),
+		),
+	},
+	{
+		Version:     14,
+		Description: "soft delete: unique names outside the trash, trash by deletion time",
+		Up: steps(
+			backfillDeletedAt,
+			dropIndex("categories", CategoriesLedgerNameIndex),
+			createIndexes("categories",
+				uniqueWhere(CategoriesLiveNameIndex, bson.D{{"ledger", 1}, {"name", 1}},
+					bson.D{{"deletedAt", bson.D{{"$type", "null"}}}}),
+				index("categories_ledger_deleted", bson.D{{"ledger", 1}, {"deletedAt", -1}}),
+			),
+			createIndexes("transactions",
+				index("transactions_ledger_deleted", bson.D{{"ledger", 1}, {"deletedAt", -1}}),
+			),
+		),
+	},
+	{
+		Version:     15,
+		Description: "audit log by resource, by ledger and by actor",
+		Up: createIndexes("audit_log",
+			index("audit_log_resource", bson.D{{"resource", 1}, {"resourceId", 1}, {"_id", -1}}),
+			index("audit_log_ledger", bson.D{{"ledger", 1}, {"_id", -1}}),
+			index("audit_log_ledger_actor", bson.D{{"ledger", 1}, {"actor", 1}, {"_id", -1}}),
+		),
+	},
+	{
+		Version:     16,
+		Description: "expire OIDC sign-in codes",
+		Up: createIndexes("oidc_codes",
+			expireAt("oidc_codes_expires", bson.D{{"expiresAt", 1}}),
+		),
+	},
+	{
+		Version:     17,
+		Description: "personal ledger for every user",
+		Up:          backfillPersonalLedgers,
+	},
+}
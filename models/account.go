@@ -0,0 +1,14 @@
+package models
+
+type EmailRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type TokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type PasswordReset struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+}
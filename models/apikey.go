@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKey is a personal access token. Only a hash of the token is stored;
+// Prefix identifies it in listings.
+type APIKey struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	Owner      primitive.ObjectID `json:"-" bson:"owner"`
+	Name       string             `json:"name" bson:"name"`
+	Prefix     string             `json:"prefix" bson:"prefix"`
+	Hash       string             `json:"-" bson:"hash"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt  *time.Time         `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	LastUsedAt *time.Time         `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name" binding:"required,max=100"`
+	Scopes []string `json:"scopes" binding:"required,min=1,dive,oneof=read:categories write:categories read:transactions write:transactions read:reports"`
+	// ExpiresInDays of 0 creates a key that does not expire.
+	ExpiresInDays int `json:"expiresInDays" binding:"gte=0,lte=365"`
+}
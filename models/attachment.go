@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Attachment describes a file stored for a transaction, such as a receipt.
+// The content lives in the blob store under the attachment's id.
+type Attachment struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Transaction primitive.ObjectID `json:"transaction" bson:"transaction"`
+	Ledger      primitive.ObjectID `json:"-" bson:"ledger"`
+	Owner       primitive.ObjectID `json:"owner" bson:"owner"`
+	Filename    string             `json:"filename" bson:"filename"`
+	ContentType string             `json:"contentType" bson:"contentType"`
+	Size        int64              `json:"size" bson:"size"`
+	Thumbnail   bool               `json:"thumbnail" bson:"thumbnail"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// BulkRequest applies Action to the transactions listed in IDs, or to all
+// transactions matching Filter when IDs is empty.
+type BulkRequest struct {
+	Action string               `json:"action" binding:"required,oneof=delete categorize tag shift-dates"`
+	IDs    []primitive.ObjectID `json:"ids" binding:"max=1000"`
+	Filter *BulkFilter          `json:"filter"`
+	// Category is the new category for "categorize". ClearCategory removes
+	// the category instead; one of them is required.
+	Category      *primitive.ObjectID `json:"category"`
+	ClearCategory bool                `json:"clearCategory"`
+	// AddTags and RemoveTags change the tags for "tag".
+	AddTags    []string `json:"addTags" binding:"max=20,dive,max=50"`
+	RemoveTags []string `json:"removeTags" binding:"max=20,dive,max=50"`
+	// Days moves dates for "shift-dates", back when negative.
+	Days int `json:"days"`
+}
+
+type BulkFilter struct {
+	From      string              `json:"from"`
+	To        string              `json:"to"`
+	Category  *primitive.ObjectID `json:"category"`
+	Tag       string              `json:"tag"`
+	MinAmount *int                `json:"minAmount"`
+	MaxAmount *int                `json:"maxAmount"`
+}
@@ -1,12 +1,26 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 // Make Type -> enum
 type Category struct {
-	ID    primitive.ObjectID `json:"id" bson:"_id"`
-	Name  string             `json:"name" binding:"required"`
-	Type  string             `json:"type" binding:"required"`
-	Owner primitive.ObjectID `bson:"owner,omitempty" json:"owner"`
-	Color string             `json:"color" bson:"color"`
+	ID      primitive.ObjectID `json:"id" bson:"_id"`
+	Name    string             `json:"name" binding:"required"`
+	Type    string             `json:"type" binding:"required"`
+	Owner   primitive.ObjectID `bson:"owner,omitempty" json:"owner"`
+	Ledger  primitive.ObjectID `bson:"ledger,omitempty" json:"ledger"`
+	Color   string             `json:"color" bson:"color"`
+	Version int                `json:"version" bson:"version"`
+	Budget  int                `json:"budget,omitempty" bson:"budget,omitempty" binding:"gte=0"` // monthly spending limit, 0 for none
+	// DeletedAt is stored as null rather than omitted so the unique name
+	// index can leave out categories in the trash.
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt"`
 }
+
+// CategoryIncome marks categories whose transactions are income. Any other
+// type is spending.
+const CategoryIncome = "income"
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Ledger groups categories and transactions shared by its members. Every
+// user has a personal ledger that can not be shared or deleted.
+type Ledger struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Name      string             `json:"name" bson:"name"`
+	Personal  bool               `json:"personal" bson:"personal"`
+	Owner     primitive.ObjectID `json:"-" bson:"owner"`
+	Members   []LedgerMember     `json:"members" bson:"members"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+type LedgerMember struct {
+	User     primitive.ObjectID `json:"user" bson:"user"`
+	Role     string             `json:"role" bson:"role"`
+	JoinedAt time.Time          `json:"joinedAt" bson:"joinedAt"`
+}
+
+type LedgerRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+type MemberRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner editor viewer"`
+}
+
+type InvitationRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner editor viewer"`
+}
+
+// Invitation is a single-use link that adds whoever accepts it to a
+// ledger. Only a hash of its token is stored.
+type Invitation struct {
+	ID         primitive.ObjectID  `json:"id" bson:"_id"`
+	Ledger     primitive.ObjectID  `json:"ledger" bson:"ledger"`
+	Role       string              `json:"role" bson:"role"`
+	Hash       string              `json:"-" bson:"hash"`
+	CreatedBy  primitive.ObjectID  `json:"createdBy" bson:"createdBy"`
+	ExpiresAt  time.Time           `json:"expiresAt" bson:"expiresAt"`
+	AcceptedBy *primitive.ObjectID `json:"acceptedBy,omitempty" bson:"acceptedBy,omitempty"`
+}
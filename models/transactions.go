@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -13,10 +15,46 @@ type Transaction struct {
 	// Count        int                      `bson:"count" json:"count"`
 	Converted    int                      `bson:"converted,omitempty" json:"converted,omitempty"`
 	Owner        primitive.ObjectID       `bson:"owner,omitempty" json:"owner"`
+	Ledger       primitive.ObjectID       `bson:"ledger,omitempty" json:"ledger"`
 	InvDt        primitive.DateTime       `bson:"invdt,omitempty" json:"invdt,omitempty"`
 	Date         string                   `json:"date" binding:"required"`
+	Description  string                   `bson:"description,omitempty" json:"description,omitempty" binding:"max=500"`
+	Payee        string                   `bson:"payee,omitempty" json:"payee,omitempty" binding:"max=200"`
+	Notes        string                   `bson:"notes,omitempty" json:"notes,omitempty" binding:"max=2000"`
+	Tags         []string                 `bson:"tags,omitempty" json:"tags,omitempty" binding:"max=20,dive,max=50"`
 	Cat          []map[string]interface{} `json:"cat" bson:"cat"`
 	Transactions []map[string]interface{} `json:"transactions" bson:"transactions"`
+	Version      int                      `json:"version" bson:"version"`
+	Type         string                   `bson:"type,omitempty" json:"type,omitempty" binding:"omitempty,oneof=expense settlement"`
+	PaidBy       primitive.ObjectID       `bson:"paidBy,omitempty" json:"paidBy"`
+	Split        *Split                   `bson:"split,omitempty" json:"split,omitempty"`
+	DeletedAt    *time.Time               `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+}
+
+const (
+	TransactionExpense    = "expense"
+	TransactionSettlement = "settlement"
+)
+
+// Split shares a transaction among ledger members. Each participant owes
+// PaidBy their Owed amount, derived from Value according to Method.
+type Split struct {
+	Method       string             `json:"method" bson:"method" binding:"required,oneof=equal exact percent shares"`
+	Participants []SplitParticipant `json:"participants" bson:"participants" binding:"required,min=1,dive"`
+}
+
+type SplitParticipant struct {
+	User  primitive.ObjectID `json:"user" bson:"user" binding:"required"`
+	Value float64            `json:"value,omitempty" bson:"value,omitempty"`
+	Owed  int                `json:"owed" bson:"owed"`
+}
+
+// Settlement records that From paid To back.
+type Settlement struct {
+	From   primitive.ObjectID `json:"from" binding:"required"`
+	To     primitive.ObjectID `json:"to" binding:"required"`
+	Amount int                `json:"amount" binding:"required,gt=0"`
+	Date   string             `json:"date" binding:"required"`
 }
 
 // Make Type -> enum
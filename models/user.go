@@ -1,17 +1,92 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type User struct {
-	ID           primitive.ObjectID   `bson:"_id"`
-	Username     string               `json:"username" binding:"required"`
-	Password     string               `json:"password" binding:"required"`
-	Email        string               `json:"email" binding:"required,email"`
-	Categories   []primitive.ObjectID `bson:"categories,omitempty"`
-	Transactions []primitive.ObjectID `bson:"transactions,omitempty"`
+	ID            primitive.ObjectID   `bson:"_id"`
+	Username      string               `json:"username" binding:"required"`
+	Password      string               `json:"password" binding:"required,max=72"`
+	Email         string               `json:"email" binding:"required,email"`
+	EmailVerified bool                 `json:"emailVerified" bson:"emailVerified"`
+	Roles         []string             `json:"-" bson:"roles,omitempty"`
+	Categories    []primitive.ObjectID `bson:"categories,omitempty"`
+	Transactions  []primitive.ObjectID `bson:"transactions,omitempty"`
+	MFA           MFA                  `json:"-" bson:"mfa,omitempty"`
+	Identities    []Identity           `json:"-" bson:"identities,omitempty"`
+}
+
+// Identity links the user to an account at an external OIDC provider.
+// Key is "provider:subject", the field that is indexed as unique.
+type Identity struct {
+	Key      string    `bson:"key"`
+	Provider string    `bson:"provider"`
+	Subject  string    `bson:"subject"`
+	LinkedAt time.Time `bson:"linkedAt"`
+}
+
+// MFA holds the TOTP second factor. PendingSecret is set during enrolment
+// until the first code is verified; recovery codes are stored hashed.
+type MFA struct {
+	Enabled       bool     `bson:"enabled"`
+	Secret        string   `bson:"secret,omitempty"`
+	PendingSecret string   `bson:"pendingSecret,omitempty"`
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty"`
+	LastStep      int64    `bson:"lastStep"`
 }
 
 type LogggedInUser struct {
 	Password string `json:"password" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
 }
+
+// Profile is the public view of a User.
+type Profile struct {
+	ID            primitive.ObjectID `json:"id"`
+	Username      string             `json:"username"`
+	Email         string             `json:"email"`
+	EmailVerified bool               `json:"emailVerified"`
+	MFAEnabled    bool               `json:"mfaEnabled"`
+}
+
+type ProfileUpdate struct {
+	Username string `json:"username"`
+	Email    string `json:"email" binding:"omitempty,email"`
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required,min=8,max=72"`
+}
+
+type MFACode struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MFASignIn completes a sign-in with a TOTP or recovery code.
+type MFASignIn struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+}
+
+// AccountDeletion re-authenticates before the account is deleted. Code is
+// only needed with 2FA enabled.
+type AccountDeletion struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// OIDCExchange redeems the code an OpenID Connect sign-in redirected with.
+type OIDCExchange struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MFADisable re-authenticates with the password and a second factor.
+// Password is only needed for accounts that have one.
+type MFADisable struct {
+	Password string `json:"password"`
+	Code     string `json:"code" binding:"required"`
+}
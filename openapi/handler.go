@@ -0,0 +1,35 @@
+package openapi
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed swagger.html
+var swaggerUI []byte
+
+type Handler struct {
+	doc *Document
+}
+
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Build generates the served document from the router's registered
+// routes. It must run after every route has been added.
+func (handler *Handler) Build(routes gin.RoutesInfo) error {
+	doc, err := Build(routes, Operations)
+	handler.doc = doc
+	return err
+}
+
+func (handler *Handler) Spec(c *gin.Context) {
+	c.JSON(http.StatusOK, handler.doc)
+}
+
+func (handler *Handler) UI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", swaggerUI)
+}
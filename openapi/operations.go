@@ -0,0 +1,269 @@
+package openapi
+
+import (
+	"net/http"
+
+	"expense-tracker-api/audit"
+	"expense-tracker-api/handlers"
+	"expense-tracker-api/models"
+	"expense-tracker-api/signing"
+)
+
+var (
+	register = Operation{Method: "POST", Path: "/api/v1/auth/register", Summary: "Register a new user", Tag: "auth",
+		Request: models.User{}, Response: CreatedUser{}, Errors: []int{http.StatusTooManyRequests, http.StatusInternalServerError}}
+	signIn = Operation{Method: "POST", Path: "/api/v1/auth/signin", Summary: "Sign in and receive a JWT", Tag: "auth",
+		Request: models.LogggedInUser{}, Response: signInResult{}, Errors: []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusInternalServerError}}
+	signInMFA = Operation{Method: "POST", Path: "/api/v1/auth/signin/mfa", Summary: "Complete a sign-in challenge with a TOTP or recovery code", Tag: "auth",
+		Request: models.MFASignIn{}, Response: handlers.JWTOutput{}, Errors: []int{http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusInternalServerError}}
+	oidcLogin = Operation{Method: "GET", Path: "/api/v1/auth/oidc/:provider/login", Summary: "Redirect to an OpenID Connect provider to sign in", Tag: "auth",
+		Status: http.StatusFound, Errors: []int{http.StatusNotFound, http.StatusTooManyRequests, http.StatusInternalServerError}}
+	oidcCallback = Operation{Method: "GET", Path: "/api/v1/auth/oidc/:provider/callback", Summary: "Complete an OpenID Connect sign-in and redirect to the frontend with a code or an error", Tag: "auth",
+		Query: []string{"code", "state", "error"}, Status: http.StatusFound,
+		Errors: []int{http.StatusNotFound, http.StatusTooManyRequests, http.StatusInternalServerError}}
+	oidcExchange = Operation{Method: "POST", Path: "/api/v1/auth/oidc/exchange", Summary: "Exchange the code from an OpenID Connect sign-in for a JWT", Tag: "auth",
+		Request: models.OIDCExchange{}, Response: signInResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusTooManyRequests, http.StatusInternalServerError}}
+	requestEmailVerification = Operation{Method: "POST", Path: "/api/v1/auth/verify-email/request", Summary: "Email a verification link", Tag: "auth",
+		Request: models.EmailRequest{}, Status: http.StatusAccepted, Response: Message{}, Errors: []int{http.StatusTooManyRequests, http.StatusInternalServerError}}
+	confirmEmailVerification = Operation{Method: "POST", Path: "/api/v1/auth/verify-email/confirm", Summary: "Verify the email address with a mailed token", Tag: "auth",
+		Request: models.TokenRequest{}, Response: Message{}, Errors: []int{http.StatusTooManyRequests, http.StatusInternalServerError}}
+	requestPasswordReset = Operation{Method: "POST", Path: "/api/v1/auth/password-reset/request", Summary: "Email a password reset link", Tag: "auth",
+		Request: models.EmailRequest{}, Status: http.StatusAccepted, Response: Message{}, Errors: []int{http.StatusTooManyRequests, http.StatusInternalServerError}}
+	confirmPasswordReset = Operation{Method: "POST", Path: "/api/v1/auth/password-reset/confirm", Summary: "Set a new password with a mailed token", Tag: "auth",
+		Request: models.PasswordReset{}, Response: Message{}, Errors: []int{http.StatusTooManyRequests, http.StatusInternalServerError}}
+
+	getProfile = Operation{Method: "GET", Path: "/api/v1/me", Summary: "Get the signed-in user's profile", Tag: "profile", Secured: true,
+		Response: models.Profile{}, Errors: []int{http.StatusNotFound}}
+	updateProfile = Operation{Method: "PATCH", Path: "/api/v1/me", Summary: "Change username or email; a new email must be verified again", Tag: "profile", Secured: true,
+		Request: models.ProfileUpdate{}, Response: models.Profile{}, Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+	changePassword = Operation{Method: "PUT", Path: "/api/v1/me/password", Summary: "Change the password", Tag: "profile", Secured: true,
+		Request: models.PasswordChange{}, Response: Message{}, Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+	deleteAccount = Operation{Method: "DELETE", Path: "/api/v1/me", Summary: "Delete the account with its categories and transactions, confirmed with the password and a 2FA code", Tag: "profile", Secured: true,
+		Request: models.AccountDeletion{}, Response: Message{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusTooManyRequests, http.StatusInternalServerError}}
+	enrollMFA = Operation{Method: "POST", Path: "/api/v1/me/mfa/enroll", Summary: "Start TOTP enrolment and get the provisioning URI", Tag: "profile", Secured: true,
+		Response: handlers.MFAEnrolment{}, Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+	verifyMFA = Operation{Method: "POST", Path: "/api/v1/me/mfa/verify", Summary: "Confirm TOTP enrolment and receive recovery codes", Tag: "profile", Secured: true,
+		Request: models.MFACode{}, Response: handlers.RecoveryCodes{}, Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+	disableMFA = Operation{Method: "POST", Path: "/api/v1/me/mfa/disable", Summary: "Disable two-factor authentication", Tag: "profile", Secured: true,
+		Request: models.MFADisable{}, Response: Message{},
+		Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusTooManyRequests, http.StatusInternalServerError}}
+	listAPIKeys = Operation{Method: "GET", Path: "/api/v1/me/api-keys", Summary: "List personal API keys", Tag: "profile", Secured: true,
+		Response: []models.APIKey{}, Errors: []int{http.StatusInternalServerError}}
+	createAPIKey = Operation{Method: "POST", Path: "/api/v1/me/api-keys", Summary: "Create a personal API key; the token is only shown once", Tag: "profile", Secured: true,
+		Request: models.APIKeyRequest{}, Status: http.StatusCreated, Response: handlers.CreatedAPIKey{}, Errors: []int{http.StatusInternalServerError}}
+	revokeAPIKey = Operation{Method: "DELETE", Path: "/api/v1/me/api-keys/:id", Summary: "Revoke a personal API key", Tag: "profile", Secured: true,
+		Response: Message{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+
+	listLedgers = Operation{Method: "GET", Path: "/api/v1/ledgers", Summary: "List the ledgers you are a member of", Tag: "ledgers", Secured: true,
+		Response: []models.Ledger{}, Errors: []int{http.StatusInternalServerError}}
+	createLedger = Operation{Method: "POST", Path: "/api/v1/ledgers", Summary: "Create a shared ledger you own", Tag: "ledgers", Secured: true,
+		Request: models.LedgerRequest{}, Status: http.StatusCreated, Response: models.Ledger{}, Errors: []int{http.StatusInternalServerError}}
+	getLedger = Operation{Method: "GET", Path: "/api/v1/ledgers/:id", Summary: "Get a ledger with its members", Tag: "ledgers", Secured: true,
+		Response: models.Ledger{}, Errors: []int{http.StatusNotFound}}
+	renameLedger = Operation{Method: "PUT", Path: "/api/v1/ledgers/:id", Summary: "Rename a ledger", Tag: "ledgers", Secured: true,
+		Request: models.LedgerRequest{}, Response: models.Ledger{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	deleteLedger = Operation{Method: "DELETE", Path: "/api/v1/ledgers/:id", Summary: "Delete a shared ledger with its categories and transactions", Tag: "ledgers", Secured: true,
+		Response: Message{}, Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+	setMemberRole = Operation{Method: "PUT", Path: "/api/v1/ledgers/:id/members/:userId", Summary: "Change a member's role", Tag: "ledgers", Secured: true,
+		Request: models.MemberRoleRequest{}, Response: Message{}, Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+	removeMember = Operation{Method: "DELETE", Path: "/api/v1/ledgers/:id/members/:userId", Summary: "Remove a member, or leave a ledger", Tag: "ledgers", Secured: true,
+		Response: Message{}, Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+	createInvitation = Operation{Method: "POST", Path: "/api/v1/ledgers/:id/invitations", Summary: "Create a single-use invitation link; the token is only shown once", Tag: "ledgers", Secured: true,
+		Request: models.InvitationRequest{}, Status: http.StatusCreated, Response: handlers.CreatedInvitation{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+	acceptInvitation = Operation{Method: "POST", Path: "/api/v1/invitations/:token/accept", Summary: "Join a ledger through an invitation", Tag: "ledgers", Secured: true,
+		Response: LedgerRef{}, Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}}
+
+	listCategories = Operation{Method: "GET", Path: "/api/v1/categories", Summary: "List categories", Tag: "categories", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Response: []models.Category{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	createCategory = Operation{Method: "POST", Path: "/api/v1/categories", Summary: "Create a category", Tag: "categories", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Request: models.Category{}, Response: models.Category{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	getCategory = Operation{Method: "GET", Path: "/api/v1/categories/:id", Summary: "Get a category", Tag: "categories", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Response: models.Category{}, Errors: []int{http.StatusNotFound}}
+	updateCategory = Operation{Method: "PUT", Path: "/api/v1/categories/:id", Summary: "Replace a category", Tag: "categories", Secured: true,
+		Headers: []string{"If-Match", handlers.LedgerHeader}, Request: models.Category{}, Response: Message{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusInternalServerError}}
+	patchCategory = Operation{Method: "PATCH", Path: "/api/v1/categories/:id", Summary: "Partially update a category with a JSON Merge Patch", Tag: "categories", Secured: true,
+		Headers: []string{"If-Match", handlers.LedgerHeader}, Consumes: "application/merge-patch+json", Request: CategoryPatch{}, Response: models.Category{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusUnsupportedMediaType, http.StatusInternalServerError}}
+	deleteCategory = Operation{Method: "DELETE", Path: "/api/v1/categories/:id", Summary: "Move a category to the trash", Tag: "categories", Secured: true,
+		Headers: []string{"If-Match", handlers.LedgerHeader}, Response: Message{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusInternalServerError}}
+
+	listTransactions = Operation{Method: "GET", Path: "/api/v1/transactions", Summary: "List latest transactions", Tag: "transactions", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Query: []string{"limit"}, Response: []models.Transaction{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	createTransaction = Operation{Method: "POST", Path: "/api/v1/transactions", Summary: "Create a transaction", Tag: "transactions", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Request: models.Transaction{}, Response: models.Transaction{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	getTransaction = Operation{Method: "GET", Path: "/api/v1/transactions/:id", Summary: "Get a transaction", Tag: "transactions", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Response: models.Transaction{}, Errors: []int{http.StatusNotFound}}
+	updateTransaction = Operation{Method: "PUT", Path: "/api/v1/transactions/:id", Summary: "Replace a transaction", Tag: "transactions", Secured: true,
+		Headers: []string{"If-Match", handlers.LedgerHeader}, Request: models.Transaction{}, Response: Message{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusInternalServerError}}
+	patchTransaction = Operation{Method: "PATCH", Path: "/api/v1/transactions/:id", Summary: "Partially update a transaction with a JSON Merge Patch", Tag: "transactions", Secured: true,
+		Headers: []string{"If-Match", handlers.LedgerHeader}, Consumes: "application/merge-patch+json", Request: TransactionPatch{}, Response: models.Transaction{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusUnsupportedMediaType, http.StatusInternalServerError}}
+	deleteTransaction = Operation{Method: "DELETE", Path: "/api/v1/transactions/:id", Summary: "Move a transaction to the trash", Tag: "transactions", Secured: true,
+		Headers: []string{"If-Match", handlers.LedgerHeader}, Response: Message{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusInternalServerError}}
+
+	bulkTransactions = Operation{Method: "POST", Path: "/api/v1/transactions/bulk", Summary: "Delete, re-categorise, re-tag or shift the dates of many transactions", Tag: "transactions", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Request: models.BulkRequest{}, Response: handlers.BulkResult{},
+		Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+
+	listAttachments = Operation{Method: "GET", Path: "/api/v1/transactions/:id/attachments", Summary: "List a transaction's attachments", Tag: "attachments", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Response: []models.Attachment{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	uploadAttachment = Operation{Method: "POST", Path: "/api/v1/transactions/:id/attachments", Summary: "Attach a receipt image or PDF to a transaction", Tag: "attachments", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Consumes: "multipart/form-data", Request: AttachmentUpload{}, Status: http.StatusCreated, Response: models.Attachment{},
+		Errors: []int{http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusInternalServerError}}
+	downloadAttachment = Operation{Method: "GET", Path: "/api/v1/transactions/:id/attachments/:attachmentId", Summary: "Download an attachment", Tag: "attachments", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Produces: "application/octet-stream", Response: binaryFile{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	downloadThumbnail = Operation{Method: "GET", Path: "/api/v1/transactions/:id/attachments/:attachmentId/thumbnail", Summary: "Download a JPEG thumbnail of an image attachment", Tag: "attachments", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Produces: "image/jpeg", Response: binaryFile{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	deleteAttachment = Operation{Method: "DELETE", Path: "/api/v1/transactions/:id/attachments/:attachmentId", Summary: "Delete an attachment", Tag: "attachments", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Response: Message{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+
+	categoryTotals = Operation{Method: "GET", Path: "/api/v1/reports/category-totals", Summary: "Transaction totals per category", Tag: "reports", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Response: []models.TransactionCategory{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	dashboard = Operation{Method: "GET", Path: "/api/v1/dashboard", Summary: "Month summary: totals against the month before, top categories, budgets and latest transactions", Tag: "reports", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Query: []string{"month", "top", "latest"},
+		Response: handlers.Dashboard{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError}}
+
+	search = Operation{Method: "GET", Path: "/api/v1/search", Summary: "Search transactions by text and category name, with date and amount filters", Tag: "search", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Query: []string{"q", "from", "to", "minAmount", "maxAmount", "limit"},
+		Response: []handlers.SearchResult{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError}}
+
+	balances = Operation{Method: "GET", Path: "/api/v1/balances", Summary: "Who owes whom in the ledger, simplified unless simplify=false", Tag: "balances", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Query: []string{"simplify"}, Response: handlers.Balances{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	settleUp = Operation{Method: "POST", Path: "/api/v1/balances/settle", Summary: "Record a payment that settles a balance between two members", Tag: "balances", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Request: models.Settlement{}, Status: http.StatusCreated, Response: models.Transaction{},
+		Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+
+	categoryTrash = Operation{Method: "GET", Path: "/api/v1/trash/categories", Summary: "List deleted categories that can still be restored", Tag: "trash", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Response: []models.Category{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	transactionTrash = Operation{Method: "GET", Path: "/api/v1/trash/transactions", Summary: "List deleted transactions that can still be restored", Tag: "trash", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Response: []models.Transaction{}, Errors: []int{http.StatusNotFound, http.StatusInternalServerError}}
+	restoreCategory = Operation{Method: "POST", Path: "/api/v1/categories/:id/restore", Summary: "Restore a category from the trash", Tag: "trash", Secured: true,
+		Headers: []string{"If-Match", handlers.LedgerHeader}, Response: models.Category{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusInternalServerError}}
+	restoreTransaction = Operation{Method: "POST", Path: "/api/v1/transactions/:id/restore", Summary: "Restore a transaction from the trash", Tag: "trash", Secured: true,
+		Headers: []string{"If-Match", handlers.LedgerHeader}, Response: models.Transaction{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusInternalServerError}}
+
+	listAudit = Operation{Method: "GET", Path: "/api/v1/audit", Summary: "Changes to the ledger's categories and transactions, newest first", Tag: "audit", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Query: []string{"resource", "actor", "before", "limit"},
+		Response: []audit.Entry{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError}}
+	categoryHistory = Operation{Method: "GET", Path: "/api/v1/categories/:id/history", Summary: "Changes to a category, including after it was deleted", Tag: "audit", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Query: []string{"before", "limit"},
+		Response: []audit.Entry{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError}}
+	transactionHistory = Operation{Method: "GET", Path: "/api/v1/transactions/:id/history", Summary: "Changes to a transaction, including after it was deleted", Tag: "audit", Secured: true,
+		Headers: []string{handlers.LedgerHeader}, Query: []string{"before", "limit"},
+		Response: []audit.Entry{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError}}
+	profileHistory = Operation{Method: "GET", Path: "/api/v1/me/history", Summary: "Changes to your account; secrets show only as redacted", Tag: "profile", Secured: true,
+		Query: []string{"before", "limit"}, Response: []audit.Entry{}, Errors: []int{http.StatusBadRequest, http.StatusInternalServerError}}
+)
+
+// Operations documents every route registered in routes.go. Adding a route
+// without an entry here (or the reverse) makes Build fail at startup.
+var Operations = []Operation{
+	{Method: "GET", Path: "/openapi.json", Summary: "OpenAPI document", Tag: "docs", Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/docs", Summary: "Swagger UI", Tag: "docs"},
+	{Method: "GET", Path: "/.well-known/jwks.json", Summary: "Public keys that verify session tokens", Tag: "auth", Response: signing.JWKS{}},
+
+	{Method: "GET", Path: "/healthz", Summary: "Liveness probe", Tag: "health", Response: Status{}},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness probe, pings the Mongo primary", Tag: "health",
+		Response: Status{}, Errors: []int{http.StatusServiceUnavailable}},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics in text exposition format", Tag: "health"},
+
+	register,
+	signIn,
+	signInMFA,
+	oidcLogin,
+	oidcCallback,
+	oidcExchange,
+	requestEmailVerification,
+	confirmEmailVerification,
+	requestPasswordReset,
+	confirmPasswordReset,
+
+	getProfile,
+	updateProfile,
+	changePassword,
+	deleteAccount,
+	enrollMFA,
+	verifyMFA,
+	disableMFA,
+	listAPIKeys,
+	createAPIKey,
+	revokeAPIKey,
+	profileHistory,
+
+	listLedgers,
+	createLedger,
+	getLedger,
+	renameLedger,
+	deleteLedger,
+	setMemberRole,
+	removeMember,
+	createInvitation,
+	acceptInvitation,
+
+	listCategories,
+	createCategory,
+	getCategory,
+	updateCategory,
+	patchCategory,
+	deleteCategory,
+
+	listTransactions,
+	createTransaction,
+	getTransaction,
+	updateTransaction,
+	patchTransaction,
+	deleteTransaction,
+	bulkTransactions,
+
+	listAttachments,
+	uploadAttachment,
+	downloadAttachment,
+	downloadThumbnail,
+	deleteAttachment,
+
+	categoryTotals,
+	dashboard,
+
+	search,
+
+	balances,
+	settleUp,
+
+	categoryTrash,
+	transactionTrash,
+	restoreCategory,
+	restoreTransaction,
+
+	listAudit,
+	categoryHistory,
+	transactionHistory,
+
+	legacy("/register", register),
+	legacy("/signin", signIn),
+	legacy("/categories", listCategories),
+	legacy("/create-category", createCategory),
+	legacy("/category/:id", getCategory),
+	legacy("/category/:id", updateCategory),
+	legacy("/category/:id", deleteCategory),
+	legacy("/create-transaction", createTransaction),
+	legacy("/transactions", listTransactions),
+	legacy("/transaction/:id", updateTransaction),
+	legacy("/transaction/:id", deleteTransaction),
+	legacy("/transaction-by-category", categoryTotals),
+}
+
+// legacy documents a deprecated alias of a versioned route.
+func legacy(path string, op Operation) Operation {
+	op.Path = path
+	op.Deprecated = true
+	return op
+}
@@ -0,0 +1,160 @@
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"expense-tracker-api/handlers"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+var (
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+	dateTimeType = reflect.TypeOf(primitive.DateTime(0))
+	timeType     = reflect.TypeOf(time.Time{})
+
+	validationOrErrorType = reflect.TypeOf(validationOrError{})
+	signInResultType      = reflect.TypeOf(signInResult{})
+	binaryFileType        = reflect.TypeOf(binaryFile{})
+)
+
+// schemaFor returns the schema of v, registering every named struct it
+// meets in components so that models are described once and referenced.
+func schemaFor(t reflect.Type, components map[string]*Schema) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case validationOrErrorType:
+		return &Schema{OneOf: []*Schema{
+			schemaFor(reflect.TypeOf(Error{}), components),
+			schemaFor(reflect.TypeOf(ValidationErrors{}), components),
+		}}
+	case signInResultType:
+		return &Schema{OneOf: []*Schema{
+			schemaFor(reflect.TypeOf(handlers.JWTOutput{}), components),
+			schemaFor(reflect.TypeOf(handlers.MFAChallenge{}), components),
+		}}
+	case binaryFileType:
+		return &Schema{Type: "string", Format: "binary"}
+	case objectIDType:
+		return &Schema{Type: "string", Format: "objectid", Pattern: "^[0-9a-f]{24}$"}
+	case dateTimeType, timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaFor(t.Elem(), components)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), components)}
+	case reflect.Interface:
+		return &Schema{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, components)
+		}
+		if _, ok := components[t.Name()]; !ok {
+			// Reserve the name first so recursive types terminate.
+			components[t.Name()] = nil
+			components[t.Name()] = structSchema(t, components)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+
+	return &Schema{}
+}
+
+func structSchema(t reflect.Type, components map[string]*Schema) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, skip := jsonName(field)
+		if skip {
+			continue
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			embedded := structSchema(field.Type, components)
+			for k, v := range embedded.Properties {
+				schema.Properties[k] = v
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+
+		property := schemaFor(field.Type, components)
+		if oneof := tagOption(field.Tag.Get("binding"), "oneof"); oneof != "" {
+			property.Enum = strings.Fields(oneof)
+		}
+		schema.Properties[name] = property
+
+		if tagOption(field.Tag.Get("binding"), "required") != "" {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+
+	return schema
+}
+
+func jsonName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", true
+	}
+
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+
+	return name, false
+}
+
+// tagOption looks up a validator option such as "required" or "oneof=a b"
+// and returns its parameter, or the option itself when it has none.
+func tagOption(tag string, option string) string {
+	for _, part := range strings.Split(tag, ",") {
+		key, value, found := strings.Cut(part, "=")
+		if key != option {
+			continue
+		}
+		if found {
+			return value
+		}
+		return key
+	}
+
+	return ""
+}
@@ -0,0 +1,69 @@
+package openapi
+
+import (
+	"net/http"
+
+	"expense-tracker-api/handlers"
+)
+
+type Error struct {
+	Error string `json:"error"`
+}
+
+type ValidationErrors struct {
+	Errors []handlers.ErrorMsg `json:"errors"`
+}
+
+type Message struct {
+	Message string `json:"message"`
+}
+
+type Status struct {
+	Status string `json:"status"`
+	Mongo  string `json:"mongo,omitempty"`
+}
+
+type CreatedUser struct {
+	User string `json:"user"`
+}
+
+type LedgerRef struct {
+	Ledger string `json:"ledger"`
+}
+
+type validationOrError struct{}
+
+// signInResult is a JWT, or an MFA challenge when 2FA is enabled.
+type signInResult struct{}
+
+// binaryFile is raw file content, uploaded or downloaded.
+type binaryFile struct{}
+
+type AttachmentUpload struct {
+	File binaryFile `json:"file" binding:"required"`
+}
+
+func errorShape(code int) interface{} {
+	if code == http.StatusBadRequest {
+		return validationOrError{}
+	}
+
+	return Error{}
+}
+
+type CategoryPatch struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Color  string `json:"color"`
+	Budget int    `json:"budget"`
+}
+
+type TransactionPatch struct {
+	Amount      int      `json:"amount"`
+	Category    string   `json:"category"`
+	Date        string   `json:"date"`
+	Description string   `json:"description"`
+	Payee       string   `json:"payee"`
+	Notes       string   `json:"notes"`
+	Tags        []string `json:"tags"`
+}
@@ -0,0 +1,249 @@
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Document struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       Info                            `json:"info"`
+	Paths      map[string]map[string]*PathItem `json:"paths"`
+	Components Components                      `json:"components"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Description  string `json:"description,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+type PathItem struct {
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *Body                 `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type Body struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Operation documents a single route. Request and Response are sample
+// values whose types are reflected into schemas.
+type Operation struct {
+	Method     string
+	Path       string
+	Summary    string
+	Tag        string
+	Secured    bool
+	Deprecated bool
+	Query      []string
+	Headers    []string
+	Consumes   string
+	Request    interface{}
+	Produces   string
+	Status     int
+	Response   interface{}
+	Errors     []int
+}
+
+// Build generates the document for routes from the documented operations
+// and reports any route that is registered without documentation or
+// documented without being registered.
+func Build(routes gin.RoutesInfo, operations []Operation) (*Document, error) {
+	doc := &Document{
+		OpenAPI: "3.0.3",
+		Info:    Info{Title: "Expense Tracker API", Version: "1.0.0"},
+		Paths:   map[string]map[string]*PathItem{},
+		Components: Components{
+			Schemas: map[string]*Schema{},
+			SecuritySchemes: map[string]*SecurityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT",
+					Description: "A session JWT from sign-in, or a personal API key (etk_...) limited to its scopes."},
+			},
+		},
+	}
+
+	documented := map[string]Operation{}
+	for _, op := range operations {
+		documented[op.Method+" "+op.Path] = op
+	}
+
+	registered := map[string]bool{}
+	var problems []string
+
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		registered[key] = true
+
+		op, ok := documented[key]
+		if !ok {
+			problems = append(problems, "undocumented route "+key)
+			continue
+		}
+
+		path, params := convertPath(route.Path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*PathItem{}
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = op.item(params, doc.Components.Schemas)
+	}
+
+	for key := range documented {
+		if !registered[key] {
+			problems = append(problems, "documented route not registered "+key)
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return doc, fmt.Errorf("openapi: spec and router diverge: %s", strings.Join(problems, "; "))
+	}
+
+	return doc, nil
+}
+
+func (op Operation) item(params []string, components map[string]*Schema) *PathItem {
+	item := &PathItem{
+		Summary:    op.Summary,
+		Deprecated: op.Deprecated,
+		Responses:  map[string]*Response{},
+	}
+
+	if op.Tag != "" {
+		item.Tags = []string{op.Tag}
+	}
+
+	for _, name := range params {
+		item.Parameters = append(item.Parameters, Parameter{
+			Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"},
+		})
+	}
+	for _, name := range op.Query {
+		item.Parameters = append(item.Parameters, Parameter{
+			Name: name, In: "query", Schema: &Schema{Type: "string"},
+		})
+	}
+	for _, name := range op.Headers {
+		item.Parameters = append(item.Parameters, Parameter{
+			Name: name, In: "header", Schema: &Schema{Type: "string"},
+		})
+	}
+
+	if op.Request != nil {
+		item.RequestBody = &Body{
+			Required: true,
+			Content:  jsonContent(op.Request, components),
+		}
+		if op.Consumes != "" {
+			item.RequestBody.Content = map[string]*MediaType{
+				op.Consumes: item.RequestBody.Content["application/json"],
+			}
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	item.Responses[strconv.Itoa(status)] = &Response{
+		Description: http.StatusText(status),
+		Content:     jsonContent(op.Response, components),
+	}
+	if op.Produces != "" {
+		response := item.Responses[strconv.Itoa(status)]
+		response.Content = map[string]*MediaType{
+			op.Produces: response.Content["application/json"],
+		}
+	}
+
+	errs := op.Errors
+	if op.Request != nil {
+		errs = append([]int{http.StatusBadRequest}, errs...)
+	}
+	for _, code := range op.Errors {
+		// Every operation that can fail in Mongo can also exceed its deadline.
+		if code == http.StatusInternalServerError {
+			errs = append(errs, http.StatusGatewayTimeout)
+			break
+		}
+	}
+	if op.Secured {
+		item.Security = []map[string][]string{{"bearerAuth": {}}}
+		// Missing credentials, or an API key without the route's scope.
+		errs = append(errs, http.StatusUnauthorized, http.StatusForbidden)
+	}
+	for _, code := range errs {
+		item.Responses[strconv.Itoa(code)] = &Response{
+			Description: http.StatusText(code),
+			Content:     jsonContent(errorShape(code), components),
+		}
+	}
+
+	return item
+}
+
+func jsonContent(v interface{}, components map[string]*Schema) map[string]*MediaType {
+	if v == nil {
+		return nil
+	}
+
+	return map[string]*MediaType{
+		"application/json": {Schema: schemaFor(reflect.TypeOf(v), components)},
+	}
+}
+
+// convertPath turns gin's ":id" and "*path" segments into OpenAPI "{id}".
+func convertPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+
+	return strings.Join(segments, "/"), params
+}
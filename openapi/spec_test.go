@@ -0,0 +1,47 @@
+package openapi_test
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"expense-tracker-api/config"
+	"expense-tracker-api/openapi"
+	"expense-tracker-api/routes"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestSpecMatchesRouter(t *testing.T) {
+	router, err := routes.Setup(config.Load(), slog.New(slog.NewTextHandler(io.Discard, nil)), routes.Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openapi.Build(router.Routes(), openapi.Operations); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildReportsDivergence(t *testing.T) {
+	router := gin.New()
+	router.GET("/undocumented", func(c *gin.Context) {})
+
+	_, err := openapi.Build(router.Routes(), []openapi.Operation{
+		{Method: "GET", Path: "/unregistered"},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, want := range []string{"undocumented route GET /undocumented", "documented route not registered GET /unregistered"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Lockout blocks a key after repeated failures. Each failure past the
+// threshold doubles the lock duration, up to a maximum.
+type Lockout interface {
+	// Locked reports how long key remains locked, zero when it is not.
+	Locked(ctx context.Context, key string) (time.Duration, error)
+	// Fail records a failure and returns the lock it triggered, if any.
+	Fail(ctx context.Context, key string) (time.Duration, error)
+	// Reset forgets the failures of key after a success.
+	Reset(ctx context.Context, key string) error
+}
+
+type LockoutPolicy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+	// Failures older than Forget no longer count.
+	Forget time.Duration
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+type MemoryLockout struct {
+	policy LockoutPolicy
+	mu     sync.Mutex
+	keys   map[string]*failures
+	now    func() time.Time
+}
+
+func NewMemoryLockout(policy LockoutPolicy) *MemoryLockout {
+	return &MemoryLockout{
+		policy: policy,
+		keys:   map[string]*failures{},
+		now:    time.Now,
+	}
+}
+
+func (lockout *MemoryLockout) Locked(ctx context.Context, key string) (time.Duration, error) {
+	lockout.mu.Lock()
+	defer lockout.mu.Unlock()
+
+	f, ok := lockout.keys[key]
+	if !ok {
+		return 0, nil
+	}
+
+	if remaining := f.lockedUntil.Sub(lockout.now()); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+func (lockout *MemoryLockout) Fail(ctx context.Context, key string) (time.Duration, error) {
+	lockout.mu.Lock()
+	defer lockout.mu.Unlock()
+
+	now := lockout.now()
+	f, ok := lockout.keys[key]
+	if !ok || now.Sub(f.last) > lockout.policy.Forget {
+		f = &failures{}
+		lockout.keys[key] = f
+	}
+
+	f.count++
+	f.last = now
+
+	over := f.count - lockout.policy.Threshold
+	if over < 0 {
+		return 0, nil
+	}
+
+	lock := lockout.policy.Base
+	for i := 0; i < over && lock < lockout.policy.Max; i++ {
+		lock *= 2
+	}
+	if lock > lockout.policy.Max {
+		lock = lockout.policy.Max
+	}
+
+	f.lockedUntil = now.Add(lock)
+	return lock, nil
+}
+
+func (lockout *MemoryLockout) Reset(ctx context.Context, key string) error {
+	lockout.mu.Lock()
+	delete(lockout.keys, key)
+	lockout.mu.Unlock()
+	return nil
+}
+
+// Cleanup drops keys whose failures no longer count and that are not
+// locked, so that sign-ins with ever new emails do not grow the map.
+func (lockout *MemoryLockout) Cleanup() {
+	lockout.mu.Lock()
+	defer lockout.mu.Unlock()
+
+	now := lockout.now()
+	for key, f := range lockout.keys {
+		if now.Sub(f.last) > lockout.policy.Forget && !now.Before(f.lockedUntil) {
+			delete(lockout.keys, key)
+		}
+	}
+}
+
+// RunCleanup calls Cleanup every interval until ctx is done.
+func (lockout *MemoryLockout) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			lockout.Cleanup()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"expense-tracker-api/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyFunc extracts what a limit applies to from the request. An empty key
+// skips the limit.
+type KeyFunc func(c *gin.Context) string
+
+func ByIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// ByEmail keys on the "email" member of a JSON body, leaving the body
+// readable for the handler.
+func ByEmail(c *gin.Context) string {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(payload.Email))
+}
+
+// Middleware rejects requests over limit with 429 and a Retry-After
+// header. name namespaces the keys so several limits can share a store.
+func Middleware(store Store, name string, limit Limit, key KeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k := key(c)
+		if k == "" {
+			c.Next()
+			return
+		}
+
+		allowed, retryAfter, err := store.Take(c.Request.Context(), name+":"+k, limit)
+		if err != nil {
+			// Fail open: an unavailable shared store must not lock everyone out.
+			logging.FromContext(c.Request.Context()).Warn("rate limit store failed", "limit", name, "error", err)
+			c.Next()
+			return
+		}
+
+		if !allowed {
+			TooManyRequests(c, retryAfter)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// TooManyRequests aborts with 429 and the number of seconds to wait.
+func TooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, retry in " + strconv.Itoa(seconds) + "s"})
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket refilled at Rate tokens per second and holding
+// at most Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func PerMinute(n int, burst int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: burst}
+}
+
+// refill is how long an empty bucket takes to fill up to Burst.
+func (limit Limit) refill() time.Duration {
+	if limit.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second))
+}
+
+// Store keeps the buckets. MemoryStore suits a single instance; several
+// instances behind a load balancer need a shared implementation (Redis,
+// Mongo) so that limits hold across them.
+type Store interface {
+	// Take consumes one token from the bucket for key and, when none is
+	// left, reports how long until one is available.
+	Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+func (store *MemoryStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := store.now()
+	b, ok := store.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		store.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	b.limit = limit
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait, nil
+}
+
+// Cleanup drops buckets that have been idle for longer than idle and
+// long enough to have refilled completely under their limit, so that
+// dropping them does not hand out a fresh burst early.
+func (store *MemoryStore) Cleanup(idle time.Duration) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := store.now()
+	for key, b := range store.buckets {
+		if since := now.Sub(b.last); since > idle && since >= b.limit.refill() {
+			delete(store.buckets, key)
+		}
+	}
+}
+
+// RunCleanup calls Cleanup with idle every interval until ctx is done.
+func (store *MemoryStore) RunCleanup(ctx context.Context, interval time.Duration, idle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			store.Cleanup(idle)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
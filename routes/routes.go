@@ -0,0 +1,228 @@
+// Package routes wires the handlers into the API router.
+package routes
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"expense-tracker-api/config"
+	"expense-tracker-api/handlers"
+	"expense-tracker-api/ledgers"
+	"expense-tracker-api/logging"
+	"expense-tracker-api/metrics"
+	"expense-tracker-api/middleware"
+	"expense-tracker-api/openapi"
+	"expense-tracker-api/ratelimit"
+	"expense-tracker-api/tracing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Legacy routes stay available as aliases of their /api/v1 successors
+// until the sunset date.
+var (
+	legacyDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset     = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+func deprecated(successor string) gin.HandlerFunc {
+	return middleware.Deprecated(successor, legacyDeprecated, legacySunset)
+}
+
+// Handlers are the request handlers the router dispatches to.
+type Handlers struct {
+	Auth         *handlers.AuthHandler
+	Accounts     *handlers.AccountHandler
+	Profile      *handlers.ProfileHandler
+	MFA          *handlers.MFAHandler
+	Sessions     *handlers.Sessions
+	APIKeys      *handlers.APIKeyHandler
+	OIDC         *handlers.OIDCHandler
+	Ledgers      *handlers.LedgerHandler
+	Categories   *handlers.CategoryHandler
+	Transactions *handlers.TransactionHandler
+	Attachments  *handlers.AttachmentHandler
+	Search       *handlers.SearchHandler
+	Bulk         *handlers.BulkHandler
+	Trash        *handlers.TrashHandler
+	Audit        *handlers.AuditHandler
+	Health       *handlers.HealthHandler
+	RateLimits   ratelimit.Store
+}
+
+// Setup builds the router. The error reports routes and OpenAPI
+// operations that do not match; the router is usable regardless.
+func Setup(cfg config.Config, logger *slog.Logger, h Handlers) (*gin.Engine, error) {
+	router := gin.New()
+
+	// The per-IP limits key on the client address, which anyone could
+	// choose through X-Forwarded-For if every proxy were trusted.
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		logger.Error("invalid TRUSTED_PROXIES, trusting none", "error", err)
+		router.SetTrustedProxies(nil)
+	}
+
+	authPerIP := ratelimit.Middleware(h.RateLimits, "auth-ip", ratelimit.PerMinute(cfg.AuthRatePerIP, cfg.AuthRatePerIP), ratelimit.ByIP)
+	signInPerEmail := ratelimit.Middleware(h.RateLimits, "signin-email", ratelimit.PerMinute(cfg.SignInRatePerEmail, cfg.SignInRatePerEmail), ratelimit.ByEmail)
+	// Each request mails the address, so allow only a few per hour.
+	mailPerEmail := ratelimit.Middleware(h.RateLimits, "mail-email", ratelimit.Limit{Rate: 3.0 / 3600, Burst: 3}, ratelimit.ByEmail)
+
+	router.Use(tracing.Middleware())
+	router.Use(metrics.Middleware())
+	router.Use(middleware.RequestID(logger))
+	router.Use(middleware.AccessLog())
+	router.Use(gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		logging.FromContext(c.Request.Context()).Error("panic", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+	router.Use(middleware.CORS(middleware.CORSPolicy{
+		AllowedOrigins:   cfg.CORSAllowedOrigins,
+		AllowedMethods:   cfg.CORSAllowedMethods,
+		AllowedHeaders:   cfg.CORSAllowedHeaders,
+		ExposedHeaders:   cfg.CORSExposedHeaders,
+		AllowCredentials: cfg.CORSAllowCredentials,
+		MaxAge:           cfg.CORSMaxAge,
+	}, map[string]middleware.CORSPolicy{
+		// The spec and the token keys are public so any tool may fetch them.
+		"/openapi.json":          {AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}, MaxAge: cfg.CORSMaxAge},
+		"/.well-known/jwks.json": {AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}, MaxAge: cfg.CORSMaxAge},
+		// Operational endpoints are for scrapers and probes, not browsers.
+		"/metrics": {},
+		"/healthz": {},
+		"/readyz":  {},
+	}))
+
+	openapiHandler := openapi.NewHandler()
+	router.GET("/openapi.json", openapiHandler.Spec)
+	router.GET("/docs", openapiHandler.UI)
+	router.GET("/.well-known/jwks.json", h.Sessions.JWKS)
+
+	router.GET("/healthz", h.Health.Healthz)
+	router.GET("/readyz", h.Health.Readyz)
+	router.GET("/metrics", metrics.Handler())
+
+	v1 := router.Group("/api/v1")
+	{
+		v1.POST("/auth/register", authPerIP, h.Auth.RegisterUser)
+		v1.POST("/auth/signin", authPerIP, signInPerEmail, h.Auth.SignInHandler)
+		v1.POST("/auth/signin/mfa", authPerIP, h.Auth.MFASignInHandler)
+		v1.GET("/auth/oidc/:provider/login", authPerIP, h.OIDC.Login)
+		v1.GET("/auth/oidc/:provider/callback", authPerIP, h.OIDC.Callback)
+		v1.POST("/auth/oidc/exchange", authPerIP, h.OIDC.Exchange)
+		v1.POST("/auth/verify-email/request", authPerIP, mailPerEmail, h.Accounts.RequestEmailVerification)
+		v1.POST("/auth/verify-email/confirm", authPerIP, h.Accounts.ConfirmEmailVerification)
+		v1.POST("/auth/password-reset/request", authPerIP, mailPerEmail, h.Accounts.RequestPasswordReset)
+		v1.POST("/auth/password-reset/confirm", authPerIP, h.Accounts.ConfirmPasswordReset)
+	}
+
+	profileScope := handlers.RequireScope(handlers.ScopeProfile)
+	readCategories := handlers.RequireScope(handlers.ScopeReadCategories)
+	writeCategories := handlers.RequireScope(handlers.ScopeWriteCategories)
+	readTransactions := handlers.RequireScope(handlers.ScopeReadTransactions)
+	writeTransactions := handlers.RequireScope(handlers.ScopeWriteTransactions)
+	readReports := handlers.RequireScope(handlers.ScopeReadReports)
+	// Data routes work on the ledger chosen by the X-Ledger-ID header.
+	viewer := h.Ledgers.Scope(ledgers.Viewer)
+	editor := h.Ledgers.Scope(ledgers.Editor)
+
+	authorizedV1 := v1.Group("/")
+	authorizedV1.Use(h.Auth.AuthMiddleware())
+	{
+		//Profile
+		authorizedV1.GET("/me", profileScope, h.Profile.GetProfile)
+		authorizedV1.PATCH("/me", profileScope, h.Profile.UpdateProfile)
+		authorizedV1.PUT("/me/password", profileScope, h.Profile.ChangePassword)
+		authorizedV1.DELETE("/me", profileScope, authPerIP, h.Profile.DeleteAccount)
+		authorizedV1.POST("/me/mfa/enroll", profileScope, h.MFA.Enroll)
+		authorizedV1.POST("/me/mfa/verify", profileScope, h.MFA.Verify)
+		authorizedV1.POST("/me/mfa/disable", profileScope, authPerIP, h.MFA.Disable)
+		authorizedV1.GET("/me/api-keys", profileScope, h.APIKeys.ListAPIKeys)
+		authorizedV1.POST("/me/api-keys", profileScope, h.APIKeys.CreateAPIKey)
+		authorizedV1.DELETE("/me/api-keys/:id", profileScope, h.APIKeys.RevokeAPIKey)
+		authorizedV1.GET("/me/history", profileScope, h.Audit.ProfileHistory)
+
+		//Ledgers
+		authorizedV1.GET("/ledgers", profileScope, h.Ledgers.ListLedgers)
+		authorizedV1.POST("/ledgers", profileScope, h.Ledgers.CreateLedger)
+		authorizedV1.GET("/ledgers/:id", profileScope, h.Ledgers.GetLedger)
+		authorizedV1.PUT("/ledgers/:id", profileScope, h.Ledgers.RenameLedger)
+		authorizedV1.DELETE("/ledgers/:id", profileScope, h.Ledgers.DeleteLedger)
+		authorizedV1.PUT("/ledgers/:id/members/:userId", profileScope, h.Ledgers.SetMemberRole)
+		authorizedV1.DELETE("/ledgers/:id/members/:userId", profileScope, h.Ledgers.RemoveMember)
+		authorizedV1.POST("/ledgers/:id/invitations", profileScope, h.Ledgers.CreateInvitation)
+		authorizedV1.POST("/invitations/:token/accept", profileScope, h.Ledgers.AcceptInvitation)
+
+		//Categories
+		authorizedV1.GET("/categories", readCategories, viewer, h.Categories.ListCategory)
+		authorizedV1.POST("/categories", writeCategories, editor, h.Categories.CreateCategory)
+		authorizedV1.GET("/categories/:id", readCategories, viewer, h.Categories.GetCategory)
+		authorizedV1.PUT("/categories/:id", writeCategories, editor, h.Categories.UpdateCategory)
+		authorizedV1.PATCH("/categories/:id", writeCategories, editor, h.Categories.PatchCategory)
+		authorizedV1.DELETE("/categories/:id", writeCategories, editor, h.Categories.DeleteCategory)
+
+		//Transactions
+		authorizedV1.GET("/transactions", readTransactions, viewer, h.Transactions.ListTransaction)
+		authorizedV1.POST("/transactions", writeTransactions, editor, h.Transactions.CreateTransaction)
+		authorizedV1.POST("/transactions/bulk", writeTransactions, editor, h.Bulk.BulkTransactions)
+		authorizedV1.GET("/transactions/:id", readTransactions, viewer, h.Transactions.GetTransaction)
+		authorizedV1.PUT("/transactions/:id", writeTransactions, editor, h.Transactions.UpdateTransaction)
+		authorizedV1.PATCH("/transactions/:id", writeTransactions, editor, h.Transactions.PatchTransaction)
+		authorizedV1.DELETE("/transactions/:id", writeTransactions, editor, h.Transactions.DeleteTransaction)
+
+		//Attachments
+		authorizedV1.GET("/transactions/:id/attachments", readTransactions, viewer, h.Attachments.ListAttachments)
+		authorizedV1.POST("/transactions/:id/attachments", writeTransactions, editor, h.Attachments.UploadAttachment)
+		authorizedV1.GET("/transactions/:id/attachments/:attachmentId", readTransactions, viewer, h.Attachments.DownloadAttachment)
+		authorizedV1.GET("/transactions/:id/attachments/:attachmentId/thumbnail", readTransactions, viewer, h.Attachments.DownloadThumbnail)
+		authorizedV1.DELETE("/transactions/:id/attachments/:attachmentId", writeTransactions, editor, h.Attachments.DeleteAttachment)
+
+		//Reports
+		authorizedV1.GET("/reports/category-totals", readReports, viewer, h.Transactions.GetTransactionsByCategory)
+		authorizedV1.GET("/dashboard", readReports, viewer, h.Transactions.GetDashboard)
+
+		//Search
+		authorizedV1.GET("/search", readTransactions, viewer, h.Search.Search)
+
+		//Balances
+		authorizedV1.GET("/balances", readReports, viewer, h.Transactions.GetBalances)
+		authorizedV1.POST("/balances/settle", writeTransactions, editor, h.Transactions.SettleUp)
+
+		//Trash
+		authorizedV1.GET("/trash/categories", readCategories, viewer, h.Trash.ListCategories)
+		authorizedV1.GET("/trash/transactions", readTransactions, viewer, h.Trash.ListTransactions)
+		authorizedV1.POST("/categories/:id/restore", writeCategories, editor, h.Trash.RestoreCategory)
+		authorizedV1.POST("/transactions/:id/restore", writeTransactions, editor, h.Trash.RestoreTransaction)
+
+		//Audit
+		authorizedV1.GET("/audit", readReports, viewer, h.Audit.ListAudit)
+		authorizedV1.GET("/categories/:id/history", readCategories, viewer, h.Audit.CategoryHistory)
+		authorizedV1.GET("/transactions/:id/history", readTransactions, viewer, h.Audit.TransactionHistory)
+	}
+
+	//Legacy aliases
+	router.POST("/register", deprecated("/api/v1/auth/register"), authPerIP, h.Auth.RegisterUser)
+	router.POST("/signin", deprecated("/api/v1/auth/signin"), authPerIP, signInPerEmail, h.Auth.SignInHandler)
+
+	authorized := router.Group("/")
+	authorized.Use(h.Auth.AuthMiddleware())
+
+	{
+		//Categories
+		authorized.GET("/categories", deprecated("/api/v1/categories"), readCategories, viewer, h.Categories.ListCategory)
+		authorized.POST("/create-category", deprecated("/api/v1/categories"), writeCategories, editor, h.Categories.CreateCategory)
+		authorized.GET("/category/:id", deprecated("/api/v1/categories/:id"), readCategories, viewer, h.Categories.GetCategory)
+		authorized.DELETE("/category/:id", deprecated("/api/v1/categories/:id"), writeCategories, editor, h.Categories.DeleteCategory)
+		authorized.PUT("/category/:id", deprecated("/api/v1/categories/:id"), writeCategories, editor, h.Categories.UpdateCategory)
+
+		//Transactions
+		authorized.POST("/create-transaction", deprecated("/api/v1/transactions"), writeTransactions, editor, h.Transactions.CreateTransaction)
+		authorized.GET("/transactions", deprecated("/api/v1/transactions"), readTransactions, viewer, h.Transactions.ListTransaction)
+		authorized.DELETE("/transaction/:id", deprecated("/api/v1/transactions/:id"), writeTransactions, editor, h.Transactions.DeleteTransaction)
+		authorized.PUT("/transaction/:id", deprecated("/api/v1/transactions/:id"), writeTransactions, editor, h.Transactions.UpdateTransaction)
+		authorized.GET("/transaction-by-category", deprecated("/api/v1/reports/category-totals"), readReports, viewer, h.Transactions.GetTransactionsByCategory)
+	}
+
+	return router, openapiHandler.Build(router.Routes())
+}
@@ -0,0 +1,298 @@
+// Package signing keeps the asymmetric keys that sign session JWTs. Keys
+// live in Mongo so every instance signs and verifies with the same set,
+// and are rotated on a schedule: the newest key signs, older keys keep
+// verifying until the last token they signed has expired.
+//
+// With a key-encryption key the private keys are sealed with AES-GCM
+// before they are stored, so reading the collection is not enough to mint
+// tokens. Without one they are stored as plain PKCS8.
+package signing
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type Key struct {
+	ID        string
+	Algorithm string
+	Created   time.Time
+	private   crypto.Signer
+	encrypted bool
+}
+
+func (key Key) method() jwt.SigningMethod {
+	if key.Algorithm == EdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+type keyDocument struct {
+	ID        string `bson:"_id"`
+	Algorithm string `bson:"alg"`
+	// PrivateKey is PKCS8 DER, sealed as nonce and ciphertext when
+	// Encrypted.
+	PrivateKey []byte    `bson:"privateKey"`
+	Encrypted  bool      `bson:"encrypted,omitempty"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+// KeySet signs with its newest key and verifies with any key that may
+// still have live tokens.
+type KeySet struct {
+	collection  *mongo.Collection
+	algorithm   string
+	rotateEvery time.Duration
+	// kek seals private keys at rest; nil stores them in the clear.
+	kek cipher.AEAD
+	// retain is how long a key verifies after it stopped signing, at
+	// least the lifetime of the tokens it signed.
+	retain time.Duration
+
+	mu   sync.RWMutex
+	keys []Key
+}
+
+// NewKeySet creates a key set. kek is a 32 byte AES-256 key that encrypts
+// the private keys in the collection, or nil to store them unencrypted.
+func NewKeySet(collection *mongo.Collection, algorithm string, rotateEvery time.Duration, retain time.Duration, kek []byte) (*KeySet, error) {
+	if algorithm != RS256 && algorithm != EdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+
+	set := &KeySet{
+		collection:  collection,
+		algorithm:   algorithm,
+		rotateEvery: rotateEvery,
+		retain:      retain,
+	}
+
+	if kek != nil {
+		if len(kek) != 32 {
+			return nil, errors.New("the key-encryption key must be 32 bytes")
+		}
+		block, err := aes.NewCipher(kek)
+		if err != nil {
+			return nil, err
+		}
+		if set.kek, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return set, nil
+}
+
+// Refresh loads the keys, creating a new one when the newest is due for
+// rotation, and deletes keys that can no longer have valid tokens.
+func (set *KeySet) Refresh(ctx context.Context) error {
+	now := time.Now()
+
+	keys, err := set.load(ctx, now.Add(-set.rotateEvery-set.retain))
+	if err != nil {
+		return err
+	}
+
+	// Once a key-encryption key is configured, a key stored before it
+	// was is replaced right away; it only keeps verifying.
+	if len(keys) == 0 || now.Sub(keys[0].Created) >= set.rotateEvery || (set.kek != nil && !keys[0].encrypted) {
+		key, err := set.generate(ctx, now)
+		if err != nil {
+			return err
+		}
+		keys = append([]Key{key}, keys...)
+		slog.Info("rotated JWT signing key", "kid", key.ID, "alg", key.Algorithm)
+	}
+
+	set.mu.Lock()
+	set.keys = keys
+	set.mu.Unlock()
+
+	_, err = set.collection.DeleteMany(ctx, bson.M{"createdAt": bson.M{"$lt": now.Add(-set.rotateEvery - set.retain)}})
+	return err
+}
+
+// Run refreshes the keys every interval until ctx is done, which picks up
+// keys rotated by other instances.
+func (set *KeySet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := set.Refresh(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("refreshing JWT signing keys failed", "error", err)
+			}
+		}
+	}
+}
+
+func (set *KeySet) load(ctx context.Context, since time.Time) ([]Key, error) {
+	cur, err := set.collection.Find(ctx, bson.M{"createdAt": bson.M{"$gte": since}},
+		options.Find().SetSort(bson.D{{"createdAt", -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	keys := []Key{}
+	for cur.Next(ctx) {
+		var doc keyDocument
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+
+		der, err := set.open(doc)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", doc.ID, err)
+		}
+
+		private, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", doc.ID, err)
+		}
+
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key %s: not a signing key", doc.ID)
+		}
+
+		keys = append(keys, Key{ID: doc.ID, Algorithm: doc.Algorithm, Created: doc.CreatedAt, private: signer, encrypted: doc.Encrypted})
+	}
+
+	return keys, cur.Err()
+}
+
+// seal encrypts a private key for storage, binding it to its key ID.
+func (set *KeySet) seal(id string, der []byte) ([]byte, error) {
+	nonce := make([]byte, set.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return set.kek.Seal(nonce, nonce, der, []byte(id)), nil
+}
+
+// open returns the PKCS8 DER of a stored key.
+func (set *KeySet) open(doc keyDocument) ([]byte, error) {
+	if !doc.Encrypted {
+		return doc.PrivateKey, nil
+	}
+	if set.kek == nil {
+		return nil, errors.New("key is encrypted but no key-encryption key is configured")
+	}
+	if len(doc.PrivateKey) < set.kek.NonceSize() {
+		return nil, errors.New("encrypted key is truncated")
+	}
+
+	nonce, sealed := doc.PrivateKey[:set.kek.NonceSize()], doc.PrivateKey[set.kek.NonceSize():]
+	return set.kek.Open(nil, nonce, sealed, []byte(doc.ID))
+}
+
+func (set *KeySet) generate(ctx context.Context, now time.Time) (Key, error) {
+	var private crypto.Signer
+	var err error
+
+	switch set.algorithm {
+	case EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return Key{}, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, err
+	}
+
+	key := Key{ID: hex.EncodeToString(id), Algorithm: set.algorithm, Created: now.UTC().Truncate(time.Millisecond), private: private}
+	doc := keyDocument{
+		ID:         key.ID,
+		Algorithm:  key.Algorithm,
+		PrivateKey: der,
+		CreatedAt:  key.Created,
+	}
+
+	if set.kek != nil {
+		if doc.PrivateKey, err = set.seal(key.ID, der); err != nil {
+			return Key{}, err
+		}
+		doc.Encrypted, key.encrypted = true, true
+	}
+
+	_, err = set.collection.InsertOne(ctx, doc)
+
+	return key, err
+}
+
+// Sign signs claims with the newest key and names it in the kid header.
+func (set *KeySet) Sign(claims jwt.Claims) (string, error) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	if len(set.keys) == 0 {
+		return "", ErrUnknownKey
+	}
+
+	key := set.keys[0]
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.private)
+}
+
+// Keyfunc finds the public key named by the token's kid, refusing tokens
+// whose alg does not match the key.
+func (set *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	for _, key := range set.keys {
+		if key.ID != kid {
+			continue
+		}
+		if token.Method.Alg() != key.method().Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return key.private.Public(), nil
+	}
+
+	return nil, ErrUnknownKey
+}
@@ -0,0 +1,217 @@
+// Package splits divides a shared expense among participants and works out
+// who owes whom.
+package splits
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	Equal   = "equal"
+	Exact   = "exact"
+	Percent = "percent"
+	Shares  = "shares"
+)
+
+var (
+	ErrAmount  = errors.New("only a positive amount can be split")
+	ErrNobody  = errors.New("a split needs at least one participant")
+	ErrExact   = errors.New("exact amounts must be whole and add up to the amount")
+	ErrPercent = errors.New("percentages must add up to 100")
+	ErrShares  = errors.New("shares must be positive")
+	ErrMethod  = errors.New("unknown split method")
+)
+
+// Compute returns what each participant owes of amount. values are the
+// exact amounts, percentages or shares depending on method and are ignored
+// for Equal. Whatever does not divide evenly goes one unit at a time to the
+// first participants, so the result always adds up to amount.
+func Compute(amount int, method string, values []float64) ([]int, error) {
+	if amount <= 0 {
+		return nil, ErrAmount
+	}
+	if len(values) == 0 {
+		return nil, ErrNobody
+	}
+
+	weights := make([]float64, len(values))
+	switch method {
+	case Equal:
+		for i := range weights {
+			weights[i] = 1
+		}
+	case Exact:
+		owed := make([]int, len(values))
+		sum := 0
+		for i, v := range values {
+			if v < 0 || v != math.Trunc(v) {
+				return nil, ErrExact
+			}
+			owed[i] = int(v)
+			sum += owed[i]
+		}
+		if sum != amount {
+			return nil, ErrExact
+		}
+		return owed, nil
+	case Percent:
+		sum := 0.0
+		for i, v := range values {
+			if v < 0 {
+				return nil, ErrPercent
+			}
+			weights[i] = v
+			sum += v
+		}
+		if math.Abs(sum-100) > 1e-6 {
+			return nil, ErrPercent
+		}
+	case Shares:
+		for i, v := range values {
+			if v <= 0 {
+				return nil, ErrShares
+			}
+			weights[i] = v
+		}
+	default:
+		return nil, ErrMethod
+	}
+
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	owed := make([]int, len(weights))
+	left := amount
+	for i, w := range weights {
+		owed[i] = int(math.Floor(float64(amount) * w / total))
+		left -= owed[i]
+	}
+	for i := 0; left > 0; i = (i + 1) % len(owed) {
+		if weights[i] > 0 {
+			owed[i]++
+			left--
+		}
+	}
+
+	return owed, nil
+}
+
+// Debt is an amount From owes To.
+type Debt struct {
+	From   primitive.ObjectID `json:"from" bson:"from"`
+	To     primitive.ObjectID `json:"to" bson:"to"`
+	Amount int                `json:"amount" bson:"amount"`
+}
+
+// Net sums debts into each user's balance: positive when they are owed
+// money, negative when they owe it.
+func Net(debts []Debt) map[primitive.ObjectID]int {
+	net := map[primitive.ObjectID]int{}
+	for _, debt := range debts {
+		net[debt.From] -= debt.Amount
+		net[debt.To] += debt.Amount
+	}
+	return net
+}
+
+// Pairwise offsets what two users owe each other, leaving at most one debt
+// per pair.
+func Pairwise(debts []Debt) []Debt {
+	type pair struct{ a, b primitive.ObjectID }
+	owed := map[pair]int{}
+
+	for _, debt := range debts {
+		if debt.From == debt.To {
+			continue
+		}
+		if less(debt.From, debt.To) {
+			owed[pair{debt.From, debt.To}] += debt.Amount
+		} else {
+			owed[pair{debt.To, debt.From}] -= debt.Amount
+		}
+	}
+
+	result := []Debt{}
+	for p, amount := range owed {
+		switch {
+		case amount > 0:
+			result = append(result, Debt{From: p.a, To: p.b, Amount: amount})
+		case amount < 0:
+			result = append(result, Debt{From: p.b, To: p.a, Amount: -amount})
+		}
+	}
+
+	sortDebts(result)
+	return result
+}
+
+// Simplify settles the same balances with fewer payments by repeatedly
+// letting the largest debtor pay the largest creditor.
+func Simplify(debts []Debt) []Debt {
+	type balance struct {
+		user   primitive.ObjectID
+		amount int
+	}
+
+	var debtors, creditors []balance
+	for user, amount := range Net(debts) {
+		switch {
+		case amount < 0:
+			debtors = append(debtors, balance{user, -amount})
+		case amount > 0:
+			creditors = append(creditors, balance{user, amount})
+		}
+	}
+
+	byAmount := func(list []balance) {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].amount != list[j].amount {
+				return list[i].amount > list[j].amount
+			}
+			return less(list[i].user, list[j].user)
+		})
+	}
+
+	result := []Debt{}
+	for len(debtors) > 0 && len(creditors) > 0 {
+		byAmount(debtors)
+		byAmount(creditors)
+
+		amount := debtors[0].amount
+		if creditors[0].amount < amount {
+			amount = creditors[0].amount
+		}
+		result = append(result, Debt{From: debtors[0].user, To: creditors[0].user, Amount: amount})
+
+		debtors[0].amount -= amount
+		creditors[0].amount -= amount
+		if debtors[0].amount == 0 {
+			debtors = debtors[1:]
+		}
+		if creditors[0].amount == 0 {
+			creditors = creditors[1:]
+		}
+	}
+
+	sortDebts(result)
+	return result
+}
+
+func less(a, b primitive.ObjectID) bool {
+	return a.Hex() < b.Hex()
+}
+
+func sortDebts(debts []Debt) {
+	sort.Slice(debts, func(i, j int) bool {
+		if debts[i].From != debts[j].From {
+			return less(debts[i].From, debts[j].From)
+		}
+		return less(debts[i].To, debts[j].To)
+	})
+}
@@ -0,0 +1,168 @@
+package splits
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Users sort in the order a, b, c.
+var (
+	a = primitive.ObjectID{1}
+	b = primitive.ObjectID{2}
+	c = primitive.ObjectID{3}
+)
+
+func TestCompute(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int
+		method string
+		values []float64
+		want   []int
+		err    error
+	}{
+		{name: "equal", amount: 90, method: Equal, values: []float64{0, 0, 0}, want: []int{30, 30, 30}},
+		{name: "equal leftover goes to the first", amount: 100, method: Equal, values: []float64{0, 0, 0}, want: []int{34, 33, 33}},
+		{name: "equal less than one each", amount: 2, method: Equal, values: []float64{0, 0, 0}, want: []int{1, 1, 0}},
+		{name: "exact", amount: 100, method: Exact, values: []float64{30, 70}, want: []int{30, 70}},
+		{name: "exact short", amount: 100, method: Exact, values: []float64{30, 60}, err: ErrExact},
+		{name: "exact fraction", amount: 100, method: Exact, values: []float64{30.5, 69.5}, err: ErrExact},
+		{name: "exact negative", amount: 100, method: Exact, values: []float64{-10, 110}, err: ErrExact},
+		{name: "percent", amount: 200, method: Percent, values: []float64{50, 25, 25}, want: []int{100, 50, 50}},
+		{name: "percent rounding", amount: 10, method: Percent, values: []float64{33.33, 33.33, 33.34}, want: []int{4, 3, 3}},
+		{name: "percent leftover skips zero", amount: 5, method: Percent, values: []float64{0, 50, 50}, want: []int{0, 3, 2}},
+		{name: "percent not 100", amount: 100, method: Percent, values: []float64{50, 40}, err: ErrPercent},
+		{name: "percent negative", amount: 100, method: Percent, values: []float64{-10, 110}, err: ErrPercent},
+		{name: "shares", amount: 10, method: Shares, values: []float64{1, 2}, want: []int{4, 6}},
+		{name: "shares fractional", amount: 100, method: Shares, values: []float64{0.5, 0.5, 1}, want: []int{25, 25, 50}},
+		{name: "shares zero", amount: 100, method: Shares, values: []float64{1, 0}, err: ErrShares},
+		{name: "zero amount", amount: 0, method: Equal, values: []float64{0}, err: ErrAmount},
+		{name: "negative amount", amount: -5, method: Equal, values: []float64{0}, err: ErrAmount},
+		{name: "nobody", amount: 100, method: Equal, err: ErrNobody},
+		{name: "unknown method", amount: 100, method: "thirds", values: []float64{1}, err: ErrMethod},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			owed, err := Compute(test.amount, test.method, test.values)
+			if err != test.err {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(owed, test.want) {
+				t.Errorf("owed = %v, want %v", owed, test.want)
+			}
+
+			if err == nil {
+				sum := 0
+				for _, o := range owed {
+					sum += o
+				}
+				if sum != test.amount {
+					t.Errorf("owed adds up to %d, want %d", sum, test.amount)
+				}
+			}
+		})
+	}
+}
+
+func TestNet(t *testing.T) {
+	tests := []struct {
+		name  string
+		debts []Debt
+		want  map[primitive.ObjectID]int
+	}{
+		{name: "none", want: map[primitive.ObjectID]int{}},
+		{
+			name:  "one debt",
+			debts: []Debt{{From: a, To: b, Amount: 10}},
+			want:  map[primitive.ObjectID]int{a: -10, b: 10},
+		},
+		{
+			name:  "cycle",
+			debts: []Debt{{From: a, To: b, Amount: 10}, {From: b, To: c, Amount: 5}, {From: c, To: a, Amount: 3}},
+			want:  map[primitive.ObjectID]int{a: -7, b: 5, c: 2},
+		},
+		{
+			name:  "settled",
+			debts: []Debt{{From: a, To: b, Amount: 10}, {From: b, To: a, Amount: 10}},
+			want:  map[primitive.ObjectID]int{a: 0, b: 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if net := Net(test.debts); !reflect.DeepEqual(net, test.want) {
+				t.Errorf("net = %v, want %v", net, test.want)
+			}
+		})
+	}
+}
+
+func TestPairwise(t *testing.T) {
+	debts := []Debt{{From: a, To: b, Amount: 10}, {From: b, To: a, Amount: 4}, {From: c, To: a, Amount: 3}, {From: a, To: a, Amount: 7}}
+	want := []Debt{{From: a, To: b, Amount: 6}, {From: c, To: a, Amount: 3}}
+
+	if got := Pairwise(debts); !reflect.DeepEqual(got, want) {
+		t.Errorf("pairwise = %v, want %v", got, want)
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	tests := []struct {
+		name  string
+		debts []Debt
+		want  []Debt
+	}{
+		{name: "none", want: []Debt{}},
+		{
+			name:  "chain",
+			debts: []Debt{{From: a, To: b, Amount: 10}, {From: b, To: c, Amount: 10}},
+			want:  []Debt{{From: a, To: c, Amount: 10}},
+		},
+		{
+			name:  "cycle",
+			debts: []Debt{{From: a, To: b, Amount: 10}, {From: b, To: c, Amount: 5}, {From: c, To: a, Amount: 3}},
+			want:  []Debt{{From: a, To: b, Amount: 5}, {From: a, To: c, Amount: 2}},
+		},
+		{
+			name:  "settled",
+			debts: []Debt{{From: a, To: b, Amount: 10}, {From: b, To: a, Amount: 10}},
+			want:  []Debt{},
+		},
+		{
+			name:  "largest debtor pays largest creditor",
+			debts: []Debt{{From: a, To: c, Amount: 8}, {From: b, To: c, Amount: 2}},
+			want:  []Debt{{From: a, To: c, Amount: 8}, {From: b, To: c, Amount: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := Simplify(test.debts)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("simplified = %v, want %v", got, test.want)
+			}
+
+			if before, after := Net(test.debts), Net(got); !sameBalances(before, after) {
+				t.Errorf("balances changed from %v to %v", before, after)
+			}
+		})
+	}
+}
+
+// sameBalances compares balances, treating a missing user as settled.
+func sameBalances(x, y map[primitive.ObjectID]int) bool {
+	for user, amount := range x {
+		if y[user] != amount {
+			return false
+		}
+	}
+	for user, amount := range y {
+		if x[user] != amount {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+// Package sso signs users in with an external OpenID Connect provider
+// using the authorization code flow with PKCE.
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Settings configure one provider. RedirectURL must point at the
+// provider's callback route and be registered with the provider.
+type Settings struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Identity is what the provider asserts about the user.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// Flow is the per-login secret state kept between redirecting to the
+// provider and handling its callback.
+type Flow struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+var ErrNonce = errors.New("ID token nonce does not match")
+
+type Provider struct {
+	Name     string
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewProvider discovers the provider's endpoints from its issuer URL.
+func NewProvider(ctx context.Context, settings Settings) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, settings.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc provider %s: %w", settings.Name, err)
+	}
+
+	scopes := settings.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+
+	return &Provider{
+		Name: settings.Name,
+		oauth: oauth2.Config{
+			ClientID:     settings.ClientID,
+			ClientSecret: settings.ClientSecret,
+			RedirectURL:  settings.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: settings.ClientID}),
+	}, nil
+}
+
+// RedirectURL is where the provider sends the user back to.
+func (provider *Provider) RedirectURL() string {
+	return provider.oauth.RedirectURL
+}
+
+func random() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Start begins a login, returning the flow to keep and the URL to send
+// the user to.
+func (provider *Provider) Start() (Flow, string, error) {
+	state, err := random()
+	if err != nil {
+		return Flow{}, "", err
+	}
+
+	nonce, err := random()
+	if err != nil {
+		return Flow{}, "", err
+	}
+
+	flow := Flow{State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier()}
+	url := provider.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(flow.Verifier))
+
+	return flow, url, nil
+}
+
+// Finish exchanges the callback's code and verifies the ID token.
+func (provider *Provider) Finish(ctx context.Context, flow Flow, code string) (Identity, error) {
+	token, err := provider.oauth.Exchange(ctx, code, oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		return Identity{}, err
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, errors.New("token response has no id_token")
+	}
+
+	idToken, err := provider.verifier.Verify(ctx, raw)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	if idToken.Nonce != flow.Nonce {
+		return Identity{}, ErrNonce
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return Identity{}, err
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Name
+	}
+
+	return Identity{
+		Provider:      provider.Name,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Username:      username,
+	}, nil
+}
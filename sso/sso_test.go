@@ -0,0 +1,128 @@
+package sso_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"expense-tracker-api/sso"
+	"expense-tracker-api/sso/ssotest"
+)
+
+func newProvider(t *testing.T) (*ssotest.IdP, *sso.Provider) {
+	t.Helper()
+
+	idp, err := ssotest.NewIdP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	provider, err := sso.NewProvider(context.Background(), sso.Settings{
+		Name:         "mock",
+		Issuer:       idp.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://api.example.com/api/v1/auth/oidc/mock/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return idp, provider
+}
+
+// signIn starts a login and has user approve it at the provider.
+func signIn(t *testing.T, idp *ssotest.IdP, provider *sso.Provider, user ssotest.User) (sso.Flow, *url.URL) {
+	t.Helper()
+
+	flow, authURL, err := provider.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := idp.Authorize(authURL, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if callback.Query().Get("state") != flow.State {
+		t.Fatalf("callback state = %q, want %q", callback.Query().Get("state"), flow.State)
+	}
+
+	return flow, callback
+}
+
+var alice = ssotest.User{Subject: "alice-id", Email: "alice@example.com", EmailVerified: true, Username: "alice"}
+
+func TestFinish(t *testing.T) {
+	idp, provider := newProvider(t)
+	flow, callback := signIn(t, idp, provider, alice)
+
+	identity, err := provider.Finish(context.Background(), flow, callback.Query().Get("code"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := sso.Identity{Provider: "mock", Subject: "alice-id", Email: "alice@example.com", EmailVerified: true, Username: "alice"}
+	if identity != want {
+		t.Errorf("identity = %+v, want %+v", identity, want)
+	}
+}
+
+func TestFinishUnverifiedEmail(t *testing.T) {
+	idp, provider := newProvider(t)
+	user := alice
+	user.EmailVerified = false
+	flow, callback := signIn(t, idp, provider, user)
+
+	identity, err := provider.Finish(context.Background(), flow, callback.Query().Get("code"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.EmailVerified {
+		t.Error("email reported as verified")
+	}
+}
+
+func TestFinishRejectsWrongVerifier(t *testing.T) {
+	idp, provider := newProvider(t)
+	flow, callback := signIn(t, idp, provider, alice)
+
+	other, _, err := provider.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow.Verifier = other.Verifier
+
+	if _, err := provider.Finish(context.Background(), flow, callback.Query().Get("code")); err == nil {
+		t.Fatal("code redeemed with another flow's PKCE verifier")
+	}
+}
+
+func TestFinishRejectsWrongNonce(t *testing.T) {
+	idp, provider := newProvider(t)
+	flow, callback := signIn(t, idp, provider, alice)
+	flow.Nonce = "replayed"
+
+	_, err := provider.Finish(context.Background(), flow, callback.Query().Get("code"))
+	if !errors.Is(err, sso.ErrNonce) {
+		t.Fatalf("err = %v, want %v", err, sso.ErrNonce)
+	}
+}
+
+func TestFinishRejectsReusedCode(t *testing.T) {
+	idp, provider := newProvider(t)
+	flow, callback := signIn(t, idp, provider, alice)
+	code := callback.Query().Get("code")
+
+	if _, err := provider.Finish(context.Background(), flow, code); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provider.Finish(context.Background(), flow, code); err == nil {
+		t.Fatal("code redeemed twice")
+	}
+}
@@ -0,0 +1,191 @@
+// Package ssotest provides a minimal OpenID Connect provider for tests. It
+// serves discovery, JWKS and token endpoints, and stands in for the user
+// approving a sign-in at the authorization endpoint.
+package ssotest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const keyID = "test"
+
+// User is who signs in at the provider.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	user        User
+}
+
+// IdP is a running provider. Its URL is the issuer.
+type IdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+func NewIdP() (*IdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	idp := &IdP{key: key, grants: map[string]grant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+
+	return idp, nil
+}
+
+// Authorize has user approve the sign-in that authURL asks for and
+// returns the redirect back to the relying party, carrying the code and
+// state.
+func (idp *IdP) Authorize(authURL string, user User) (*url.URL, error) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		return nil, err
+	}
+	query := parsed.Query()
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		return nil, errors.New("ssotest: sign-in without a PKCE S256 challenge")
+	}
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		return nil, err
+	}
+
+	code := make([]byte, 16)
+	rand.Read(code)
+
+	idp.mu.Lock()
+	idp.grants[hex.EncodeToString(code)] = grant{
+		clientID:    query.Get("client_id"),
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		user:        user,
+	}
+	idp.mu.Unlock()
+
+	values := redirect.Query()
+	values.Set("code", hex.EncodeToString(code))
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+
+	return redirect, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	public := idp.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}},
+	})
+}
+
+// token redeems a code once, checking the PKCE verifier against the
+// challenge it was issued for.
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	idp.mu.Lock()
+	g, ok := idp.grants[r.Form.Get("code")]
+	delete(idp.grants, r.Form.Get("code"))
+	idp.mu.Unlock()
+
+	clientID, _, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.Form.Get("client_id")
+	}
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || clientID != g.clientID || r.Form.Get("redirect_uri") != g.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                idp.URL,
+		"aud":                g.clientID,
+		"sub":                g.user.Subject,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              g.nonce,
+		"email":              g.user.Email,
+		"email_verified":     g.user.EmailVerified,
+		"preferred_username": g.user.Username,
+	})
+	token.Header["kid"] = keyID
+
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access-" + r.Form.Get("code"),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
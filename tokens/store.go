@@ -0,0 +1,62 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrUsed = errors.New("token was already used")
+
+// Store records issued tokens so each can be consumed once. Records expire
+// through a TTL index on expiresAt.
+type Store struct {
+	collection *mongo.Collection
+}
+
+func NewStore(collection *mongo.Collection) *Store {
+	return &Store{collection: collection}
+}
+
+func (store *Store) Save(ctx context.Context, payload Payload) error {
+	_, err := store.collection.InsertOne(ctx, bson.M{
+		"_id":       payload.ID,
+		"purpose":   payload.Purpose,
+		"user":      payload.UserID,
+		"expiresAt": payload.ExpiresAt,
+	})
+	return err
+}
+
+// Consume marks the token as used, failing with ErrUsed if it already was
+// or was never issued.
+func (store *Store) Consume(ctx context.Context, payload Payload) error {
+	result, err := store.collection.UpdateOne(ctx, bson.M{
+		"_id":    payload.ID,
+		"usedAt": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"usedAt": time.Now()}})
+
+	if err != nil {
+		return err
+	}
+
+	if result.ModifiedCount == 0 {
+		return ErrUsed
+	}
+
+	return nil
+}
+
+// Revoke invalidates every unused token of a purpose issued to a user,
+// for example older reset links once the password has changed.
+func (store *Store) Revoke(ctx context.Context, userID string, purpose Purpose) error {
+	_, err := store.collection.UpdateMany(ctx, bson.M{
+		"user":    userID,
+		"purpose": purpose,
+		"usedAt":  bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"usedAt": time.Now()}})
+	return err
+}